@@ -0,0 +1,159 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// kinds of redundancy found between rules
+const (
+	ruleDuplicate = "duplicate"
+	ruleSubsumed  = "subsumed"
+	ruleMergeable = "mergeable"
+)
+
+// RuleWarning describes a rule that is redundant with another one
+type RuleWarning struct {
+	Direction string `json:"direction"`
+	Kind      string `json:"kind"`
+	Rule      rule   `json:"rule"`
+	By        rule   `json:"by"`
+}
+
+func (w RuleWarning) String() string {
+	relation := map[string]string{
+		ruleDuplicate: "duplicates",
+		ruleSubsumed:  "is subsumed by",
+		ruleMergeable: "can be merged with",
+	}[w.Kind]
+
+	return fmt.Sprintf("%s rule %s %s %s", w.Direction, describeRule(w.Rule), relation, describeRule(w.By))
+}
+
+func describeRule(r rule) string {
+	return fmt.Sprintf("%s %d-%d %s", r.Protocol, r.FromPort, r.ToPort, r.source())
+}
+
+// analyze warns about redundant rules in the event
+func (ev *Event) analyze() {
+	ingress := expandRules(ev.SecurityGroupRules.Ingress)
+	egress := expandRules(ev.SecurityGroupRules.Egress)
+
+	ev.Warnings = append(analyzeRules("ingress", ingress), analyzeRules("egress", egress)...)
+}
+
+func analyzeRules(direction string, rules []rule) []RuleWarning {
+	var warnings []RuleWarning
+
+	for i := range rules {
+		for j := range rules {
+			if i == j {
+				continue
+			}
+
+			kind := redundancy(rules[i], rules[j])
+
+			// report every pair once, the later rule being redundant
+			if kind == "" || (kind != ruleSubsumed && j > i) {
+				continue
+			}
+
+			warnings = append(warnings, RuleWarning{
+				Direction: direction,
+				Kind:      kind,
+				Rule:      rules[i],
+				By:        rules[j],
+			})
+		}
+	}
+
+	return warnings
+}
+
+// redundancy reports how rule a is made redundant by rule b, if it is
+func redundancy(a, b rule) string {
+	// only cidrs can overlap, groups and prefix lists are left alone
+	an, err := parseNetwork(a.cidr())
+	if err != nil {
+		return ""
+	}
+
+	bn, err := parseNetwork(b.cidr())
+	if err != nil {
+		return ""
+	}
+
+	ap := protocolName(a.Protocol)
+	bp := protocolName(b.Protocol)
+
+	if ap == bp && an.String() == bn.String() && a.FromPort == b.FromPort && a.ToPort == b.ToPort {
+		return ruleDuplicate
+	}
+
+	if (ap == bp || bp == "all") && covers(bn, an) && (bp == "all" || portsCover(ap, b, a)) {
+		return ruleSubsumed
+	}
+
+	if ap == bp && hasPortRange(ap) && an.String() == bn.String() && !portsCover(ap, a, b) &&
+		a.FromPort <= b.ToPort+1 && b.FromPort <= a.ToPort+1 {
+		return ruleMergeable
+	}
+
+	return ""
+}
+
+// collapseRules drops duplicate and subsumed rules, and merges overlapping
+// or adjacent port ranges on the same cidr, keeping the rules' order
+func collapseRules(rules []rule) []rule {
+	collapsed := append([]rule{}, rules...)
+
+	for changed := true; changed; {
+		changed = false
+
+		for i := 0; i < len(collapsed) && !changed; i++ {
+			for j := 0; j < len(collapsed) && !changed; j++ {
+				if i == j {
+					continue
+				}
+
+				switch redundancy(collapsed[j], collapsed[i]) {
+				case ruleDuplicate, ruleSubsumed:
+					collapsed = append(collapsed[:j], collapsed[j+1:]...)
+					changed = true
+				case ruleMergeable:
+					if collapsed[j].FromPort < collapsed[i].FromPort {
+						collapsed[i].FromPort = collapsed[j].FromPort
+					}
+					if collapsed[j].ToPort > collapsed[i].ToPort {
+						collapsed[i].ToPort = collapsed[j].ToPort
+					}
+					collapsed = append(collapsed[:j], collapsed[j+1:]...)
+					changed = true
+				}
+			}
+		}
+	}
+
+	return collapsed
+}
+
+func parseNetwork(cidr string) (*net.IPNet, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	return network, err
+}
+
+func hasPortRange(protocol string) bool {
+	return protocol == "tcp" || protocol == "udp"
+}
+
+// portsCover reports if rule a's ports include all of rule b's
+func portsCover(protocol string, a, b rule) bool {
+	if !hasPortRange(protocol) {
+		return a.FromPort == b.FromPort && a.ToPort == b.ToPort
+	}
+	return a.FromPort <= b.FromPort && a.ToPort >= b.ToPort
+}
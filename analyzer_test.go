@@ -0,0 +1,123 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAnalyzer(t *testing.T) {
+	Convey("Given a ruleset", t, func() {
+		Convey("With no redundant rules", func() {
+			rules := []rule{
+				rule{IP: "10.0.0.0/24", FromPort: 80, ToPort: 80, Protocol: "tcp"},
+				rule{IP: "10.0.0.0/24", FromPort: 80, ToPort: 80, Protocol: "udp"},
+				rule{IP: "10.0.1.0/24", FromPort: 80, ToPort: 80, Protocol: "tcp"},
+			}
+			Convey("It should not warn", func() {
+				So(len(analyzeRules("ingress", rules)), ShouldEqual, 0)
+				So(collapseRules(rules), ShouldResemble, rules)
+			})
+		})
+
+		Convey("With duplicate rules", func() {
+			rules := []rule{
+				rule{IP: "10.0.0.0/24", FromPort: 80, ToPort: 80, Protocol: "tcp"},
+				rule{IP: "10.0.0.1/24", FromPort: 80, ToPort: 80, Protocol: "6"},
+			}
+			warnings := analyzeRules("ingress", rules)
+			Convey("It should warn about the later rule", func() {
+				So(len(warnings), ShouldEqual, 1)
+				So(warnings[0].Kind, ShouldEqual, "duplicate")
+				So(warnings[0].Rule.IP, ShouldEqual, "10.0.0.1/24")
+				So(warnings[0].String(), ShouldEqual, "ingress rule 6 80-80 10.0.0.1/24 duplicates tcp 80-80 10.0.0.0/24")
+			})
+			Convey("It should keep the first rule when collapsing", func() {
+				So(collapseRules(rules), ShouldResemble, rules[:1])
+			})
+		})
+
+		Convey("With a rule inside a wider one", func() {
+			rules := []rule{
+				rule{IP: "10.0.0.1/32", FromPort: 443, ToPort: 443, Protocol: "tcp"},
+				rule{IP: "10.0.0.0/24", FromPort: 0, ToPort: 1024, Protocol: "tcp"},
+				rule{IP: "10.0.0.0/16", Protocol: "-1"},
+			}
+			warnings := analyzeRules("egress", rules)
+			Convey("It should warn about every subsumed rule", func() {
+				So(len(warnings), ShouldEqual, 3)
+				So(warnings[0].Kind, ShouldEqual, "subsumed")
+				So(warnings[0].Rule.IP, ShouldEqual, "10.0.0.1/32")
+				So(warnings[0].By.IP, ShouldEqual, "10.0.0.0/24")
+				So(warnings[1].By.IP, ShouldEqual, "10.0.0.0/16")
+				So(warnings[2].Rule.IP, ShouldEqual, "10.0.0.0/24")
+			})
+			Convey("It should keep the widest rule when collapsing", func() {
+				collapsed := collapseRules(rules)
+				So(len(collapsed), ShouldEqual, 1)
+				So(collapsed[0].IP, ShouldEqual, "10.0.0.0/16")
+			})
+		})
+
+		Convey("With adjacent and overlapping port ranges", func() {
+			rules := []rule{
+				rule{IP: "10.0.0.0/24", FromPort: 8000, ToPort: 8080, Protocol: "tcp"},
+				rule{IP: "10.0.0.0/24", FromPort: 22, ToPort: 22, Protocol: "tcp"},
+				rule{IP: "10.0.0.0/24", FromPort: 8081, ToPort: 8100, Protocol: "tcp"},
+				rule{IP: "10.0.0.0/24", FromPort: 8050, ToPort: 8200, Protocol: "tcp"},
+			}
+			warnings := analyzeRules("ingress", rules)
+			Convey("It should warn about the mergeable rules", func() {
+				So(len(warnings), ShouldEqual, 3)
+				So(warnings[0].Kind, ShouldEqual, "mergeable")
+				So(warnings[0].Rule.FromPort, ShouldEqual, 8081)
+				So(warnings[1].Kind, ShouldEqual, "subsumed")
+				So(warnings[1].Rule.FromPort, ShouldEqual, 8081)
+				So(warnings[2].Kind, ShouldEqual, "mergeable")
+				So(warnings[2].Rule.FromPort, ShouldEqual, 8050)
+			})
+			Convey("It should merge them when collapsing", func() {
+				collapsed := collapseRules(rules)
+				So(len(collapsed), ShouldEqual, 2)
+				So(collapsed[0].FromPort, ShouldEqual, 8000)
+				So(collapsed[0].ToPort, ShouldEqual, 8200)
+				So(collapsed[1].FromPort, ShouldEqual, 22)
+			})
+		})
+
+		Convey("When analyzing an event that asks to collapse rules using a cidr group", func() {
+			cidrGroups.set("office", []string{"10.1.0.0/16"})
+			defer cidrGroups.replace(nil)
+			ev := testEvent
+			buildTestRules(&ev)
+			ev.CollapseRules = true
+			ev.SecurityGroupRules.Ingress[0].IP = "@office"
+			ev.analyze()
+			Convey("It should still reference the group", func() {
+				So(ev.usesCIDRGroup("office"), ShouldBeTrue)
+			})
+		})
+
+		Convey("When analyzing an event that asks to collapse its rules", func() {
+			ev := testEvent
+			buildTestRules(&ev)
+			ev.CollapseRules = true
+			ev.SecurityGroupRules.Ingress = append(ev.SecurityGroupRules.Ingress, ev.SecurityGroupRules.Ingress[0])
+			ev.analyze()
+			Convey("It should report the warnings and collapse the applied rules", func() {
+				So(len(ev.Warnings), ShouldEqual, 1)
+				So(ev.Warnings[0].Direction, ShouldEqual, "ingress")
+				ingress, egress := ev.desiredRules()
+				So(len(ingress), ShouldEqual, 1)
+				So(len(egress), ShouldEqual, 1)
+			})
+			Convey("It should keep the event's own rules", func() {
+				So(len(ev.SecurityGroupRules.Ingress), ShouldEqual, 2)
+			})
+		})
+	})
+}
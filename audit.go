@@ -0,0 +1,183 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+var audit auditSink
+
+// ErrAuditLogTampered is returned when the audit log hash chain is broken
+var ErrAuditLogTampered = errors.New("Audit log hash chain is broken")
+
+// auditState holds the rules of one direction of a security group before
+// and after it is updated
+type auditState struct {
+	Before []rule `json:"before"`
+	After  []rule `json:"after"`
+}
+
+type auditEntry struct {
+	Timestamp          time.Time `json:"timestamp"`
+	UUID               string    `json:"_uuid"`
+	BatchID            string    `json:"_batch_id"`
+	SecurityGroupAWSID string    `json:"security_group_aws_id"`
+	Action             string    `json:"action"`
+	Direction          string    `json:"direction"`
+	Rules              []rule    `json:"rules"`
+	auditState
+	RequestID string `json:"aws_request_id"`
+	PrevHash  string `json:"prev_hash,omitempty"`
+	Hash      string `json:"hash,omitempty"`
+}
+
+func newAuditEntry(ev *Event, action, direction string, perms []*ec2.IpPermission, state auditState) auditEntry {
+	return auditEntry{
+		Timestamp:          time.Now().UTC(),
+		UUID:               ev.UUID,
+		BatchID:            ev.BatchID,
+		SecurityGroupAWSID: ev.SecurityGroupAWSID,
+		Action:             action,
+		Direction:          direction,
+		Rules:              buildRules(perms),
+		auditState:         state,
+	}
+}
+
+// chain links the entry to the previous one, hashing its content along
+// with the previous entry's hash
+func (e *auditEntry) chain(prev string) error {
+	e.PrevHash = prev
+	e.Hash = ""
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	e.Hash = hex.EncodeToString(sum[:])
+
+	return nil
+}
+
+type auditSink interface {
+	Write(e *auditEntry) error
+}
+
+func configureAudit(path, subject string) (auditSink, error) {
+	switch {
+	case path != "":
+		s, err := newFileAuditSink(path)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case subject != "":
+		return &natsAuditSink{subject: subject}, nil
+	}
+	return nil, nil
+}
+
+// fileAuditSink appends hash chained entries to a json lines file
+type fileAuditSink struct {
+	mu   sync.Mutex
+	f    *os.File
+	last string
+}
+
+func newFileAuditSink(path string) (*fileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	last, err := verifyAuditLog(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &fileAuditSink{f: f, last: last}, nil
+}
+
+func (s *fileAuditSink) Write(e *auditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := e.chain(s.last); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if _, err = s.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	if err = s.f.Sync(); err != nil {
+		return err
+	}
+
+	s.last = e.Hash
+
+	return nil
+}
+
+// natsAuditSink publishes entries on a nats subject
+type natsAuditSink struct {
+	subject string
+}
+
+func (s *natsAuditSink) Write(e *auditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return nc.Publish(s.subject, data)
+}
+
+// verifyAuditLog checks the hash chain of an audit log, returning the hash
+// of its last entry
+func verifyAuditLog(r io.Reader) (string, error) {
+	var last string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var e auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return "", ErrAuditLogTampered
+		}
+
+		hash := e.Hash
+		if err := e.chain(last); err != nil {
+			return "", err
+		}
+
+		if e.Hash != hash {
+			return "", ErrAuditLogTampered
+		}
+
+		last = hash
+	}
+
+	return last, scanner.Err()
+}
@@ -0,0 +1,87 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAudit(t *testing.T) {
+	ev := testEvent
+	buildTestRules(&ev)
+
+	Convey("Given a file audit sink", t, func() {
+		dir, _ := ioutil.TempDir("", "audit")
+		path := filepath.Join(dir, "audit.jsonl")
+
+		perms := buildPermissions(ev.SecurityGroupRules.Ingress)
+		state := auditState{After: ev.SecurityGroupRules.Ingress}
+
+		sink, err := newFileAuditSink(path)
+		So(err, ShouldBeNil)
+
+		first := newAuditEntry(&ev, "authorize", "ingress", perms, state)
+		first.RequestID = "req-1"
+		So(sink.Write(&first), ShouldBeNil)
+
+		second := newAuditEntry(&ev, "authorize", "ingress", perms, state)
+		second.RequestID = "req-2"
+		So(sink.Write(&second), ShouldBeNil)
+
+		Convey("When writing entries", func() {
+			data, _ := ioutil.ReadFile(path)
+			Convey("It should chain them by hash", func() {
+				So(first.PrevHash, ShouldEqual, "")
+				So(second.PrevHash, ShouldEqual, first.Hash)
+				So(string(data), ShouldContainSubstring, `"aws_request_id":"req-1"`)
+				So(string(data), ShouldContainSubstring, `"security_group_aws_id":"sg-0000000"`)
+				So(string(data), ShouldContainSubstring, `"after":[{"ip":"10.0.10.100/32"`)
+			})
+		})
+
+		Convey("When reopening the log", func() {
+			reopened, err := newFileAuditSink(path)
+			So(err, ShouldBeNil)
+			third := newAuditEntry(&ev, "revoke", "egress", perms, state)
+			reopened.Write(&third)
+			Convey("It should continue the chain", func() {
+				So(third.PrevHash, ShouldEqual, second.Hash)
+				f, _ := os.Open(path)
+				defer f.Close()
+				last, err := verifyAuditLog(f)
+				So(err, ShouldBeNil)
+				So(last, ShouldEqual, third.Hash)
+			})
+		})
+
+		Convey("When an entry is tampered with", func() {
+			data, _ := ioutil.ReadFile(path)
+			data = bytes.Replace(data, []byte(`"req-1"`), []byte(`"req-9"`), 1)
+			_, err := verifyAuditLog(bytes.NewReader(data))
+			Convey("It should detect it", func() {
+				So(err, ShouldEqual, ErrAuditLogTampered)
+			})
+		})
+
+		Convey("When an entry is removed", func() {
+			data, _ := ioutil.ReadFile(path)
+			lines := bytes.SplitAfter(data, []byte("\n"))
+			_, err := verifyAuditLog(bytes.NewReader(lines[1]))
+			Convey("It should detect it", func() {
+				So(err, ShouldEqual, ErrAuditLogTampered)
+			})
+		})
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -0,0 +1,219 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/nats-io/nats"
+)
+
+var ErrBatchEmpty = errors.New("Batch must contain security groups")
+
+// number of security groups of a batch applied at the same time
+var batchConcurrency = 4
+
+// Batch holds several security groups sharing a batch, a datacenter and
+// its credentials
+type Batch struct {
+	UUID                  string            `json:"_uuid"`
+	BatchID               string            `json:"_batch_id"`
+	ProviderType          string            `json:"_type"`
+	VPCID                 string            `json:"vpc_id"`
+	DatacenterRegion      string            `json:"datacenter_region"`
+	DatacenterAccessKey   string            `json:"datacenter_secret"`
+	DatacenterAccessToken string            `json:"datacenter_token"`
+	MaxIngressRules       int               `json:"max_ingress_rules,omitempty"`
+	MaxEgressRules        int               `json:"max_egress_rules,omitempty"`
+	TraceContext          map[string]string `json:"_trace,omitempty"`
+	Groups                []Event           `json:"groups"`
+}
+
+// BatchResult reports the outcome of every security group of a batch,
+// leaving out the credentials
+type BatchResult struct {
+	UUID         string        `json:"_uuid"`
+	BatchID      string        `json:"_batch_id"`
+	ProviderType string        `json:"_type"`
+	Groups       []groupResult `json:"groups"`
+	ErrorMessage string        `json:"error,omitempty"`
+}
+
+type groupResult struct {
+	UUID               string `json:"_uuid,omitempty"`
+	SecurityGroupAWSID string `json:"security_group_aws_id,omitempty"`
+	SecurityGroupName  string `json:"name"`
+	ErrorMessage       string `json:"error,omitempty"`
+}
+
+// Validate checks if the criteria shared by the batch's groups are met
+func (b *Batch) Validate() error {
+	if b.DatacenterRegion == "" {
+		return ErrDatacenterRegionInvalid
+	}
+
+	if b.DatacenterAccessKey == "" || b.DatacenterAccessToken == "" {
+		return ErrDatacenterCredentialsInvalid
+	}
+
+	if len(b.Groups) < 1 {
+		return ErrBatchEmpty
+	}
+
+	return nil
+}
+
+// event returns the batch as an event, holding the fields its groups share
+func (b *Batch) event() Event {
+	return Event{
+		UUID:                  b.UUID,
+		BatchID:               b.BatchID,
+		ProviderType:          b.ProviderType,
+		VPCID:                 b.VPCID,
+		DatacenterRegion:      b.DatacenterRegion,
+		DatacenterAccessKey:   b.DatacenterAccessKey,
+		DatacenterAccessToken: b.DatacenterAccessToken,
+		TraceContext:          b.TraceContext,
+		subject:               "firewall.batch.aws",
+	}
+}
+
+// group returns a group of the batch as an event of its own
+func (b *Batch) group(i int) Event {
+	ev := b.Groups[i]
+	ev.BatchID = b.BatchID
+	ev.ProviderType = b.ProviderType
+	ev.DatacenterRegion = b.DatacenterRegion
+	ev.DatacenterAccessKey = b.DatacenterAccessKey
+	ev.DatacenterAccessToken = b.DatacenterAccessToken
+	if ev.VPCID == "" {
+		ev.VPCID = b.VPCID
+	}
+	if ev.MaxIngressRules == 0 {
+		ev.MaxIngressRules = b.MaxIngressRules
+	}
+	if ev.MaxEgressRules == 0 {
+		ev.MaxEgressRules = b.MaxEgressRules
+	}
+	ev.subject = "firewall.update.aws"
+	return ev
+}
+
+func (b *Batch) result() BatchResult {
+	return BatchResult{
+		UUID:         b.UUID,
+		BatchID:      b.BatchID,
+		ProviderType: b.ProviderType,
+	}
+}
+
+func (r *BatchResult) publish() {
+	status := "done"
+	if r.ErrorMessage != "" {
+		status = "error"
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		logger.WithField("batch_id", r.BatchID).Panic(err)
+	}
+	publish("firewall.batch.aws."+status, data)
+}
+
+// batchEventHandler applies every security group of a batch, sharing one
+// client, and publishes the result of each group as if it was sent on
+// its own, followed by the result of the batch
+func batchEventHandler(m *nats.Msg) {
+	var b Batch
+
+	if err := json.Unmarshal(m.Data, &b); err != nil {
+		eventsReceived.Inc()
+		eventsErrored.WithLabelValues("DecodeError").Inc()
+		publish("firewall.batch.aws.error", m.Data)
+		return
+	}
+
+	// count every group as an event received, as they are counted once
+	// validated, completed or errored
+	received := float64(len(b.Groups))
+	if received < 1 {
+		received = 1
+	}
+	eventsReceived.Add(received)
+
+	template := b.event()
+	ctx, span := template.startSpan(template.context(), "firewall.batch.aws")
+	defer span.End()
+
+	result := b.result()
+
+	if err := b.Validate(); err != nil {
+		eventsErrored.WithLabelValues("ValidationError").Add(received)
+		failSpan(span, err)
+		template.log("firewall.batch.aws").WithError(err).Error("request failed")
+		result.ErrorMessage = err.Error()
+		result.publish()
+		return
+	}
+
+	svc := ec2Client(&template)
+
+	result.Groups = make([]groupResult, len(b.Groups))
+	// like WORKERS, at least one group is applied at a time
+	concurrency := batchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for i := range b.Groups {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			ev := b.group(i)
+			ctx, span := ev.startSpan(ctx, "firewall.update.aws")
+			defer span.End()
+			ev.inject(ctx)
+
+			err := processEvent(ctx, svc, &ev)
+			if err != nil {
+				failSpan(span, err)
+				ev.Error(err)
+			} else {
+				ev.Complete()
+			}
+
+			result.Groups[i] = groupResult{
+				UUID:               ev.UUID,
+				SecurityGroupAWSID: ev.SecurityGroupAWSID,
+				SecurityGroupName:  ev.SecurityGroupName,
+				ErrorMessage:       ev.ErrorMessage,
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var failed int
+	for _, g := range result.Groups {
+		if g.ErrorMessage != "" {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		result.ErrorMessage = strconv.Itoa(failed) + " of " + strconv.Itoa(len(result.Groups)) + " security groups failed"
+		failSpan(span, errors.New(result.ErrorMessage))
+	}
+
+	result.publish()
+}
@@ -0,0 +1,140 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/nats-io/nats"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testBatch() Batch {
+	b := Batch{
+		UUID:                  "test",
+		BatchID:               "test",
+		ProviderType:          "aws",
+		VPCID:                 "vpc-0000000",
+		DatacenterRegion:      "eu-west-1",
+		DatacenterAccessKey:   "key",
+		DatacenterAccessToken: "token",
+	}
+
+	for _, name := range []string{"web", "db"} {
+		var ev Event
+		ev.UUID = name
+		ev.SecurityGroupName = name
+		buildTestRules(&ev)
+		b.Groups = append(b.Groups, ev)
+	}
+
+	return b
+}
+
+func TestBatch(t *testing.T) {
+	_, errored := testSetup()
+
+	Convey("Given a batch", t, func() {
+		b := testBatch()
+
+		Convey("With valid fields", func() {
+			Convey("It should not error", func() {
+				So(b.Validate(), ShouldBeNil)
+			})
+		})
+
+		Convey("With no groups", func() {
+			b.Groups = nil
+			Convey("It should error", func() {
+				So(b.Validate(), ShouldEqual, ErrBatchEmpty)
+			})
+		})
+
+		Convey("With no datacenter credentials", func() {
+			b.DatacenterAccessToken = ""
+			Convey("It should error", func() {
+				So(b.Validate(), ShouldEqual, ErrDatacenterCredentialsInvalid)
+			})
+		})
+
+		Convey("When building the event of a group", func() {
+			b.Groups[1].VPCID = "vpc-1111111"
+			web := b.group(0)
+			db := b.group(1)
+			Convey("It should inherit the fields of the batch", func() {
+				So(web.UUID, ShouldEqual, "web")
+				So(web.BatchID, ShouldEqual, "test")
+				So(web.DatacenterRegion, ShouldEqual, "eu-west-1")
+				So(web.DatacenterAccessKey, ShouldEqual, "key")
+				So(web.VPCID, ShouldEqual, "vpc-0000000")
+				So(web.Validate(), ShouldBeNil)
+				So(db.VPCID, ShouldEqual, "vpc-1111111")
+			})
+		})
+
+		Convey("When handling a batch with invalid groups", func() {
+			batchErrored := make(chan *nats.Msg, 1)
+			sub, _ := nc.ChanSubscribe("firewall.batch.aws.error", batchErrored)
+
+			b.Groups[0].SecurityGroupName = ""
+			b.Groups[1].SecurityGroupRules.Ingress = nil
+			b.Groups[1].SecurityGroupRules.Egress = nil
+			data, _ := json.Marshal(b)
+			batchEventHandler(&nats.Msg{Data: data})
+
+			Convey("It should publish an error for every group", func() {
+				for i := 0; i < 2; i++ {
+					_, timeout := waitMsg(errored)
+					So(timeout, ShouldBeNil)
+				}
+			})
+
+			Convey("It should publish the result of the batch", func() {
+				msg, timeout := waitMsg(batchErrored)
+				So(timeout, ShouldBeNil)
+				var r BatchResult
+				json.Unmarshal(msg.Data, &r)
+				So(r.BatchID, ShouldEqual, "test")
+				So(r.ErrorMessage, ShouldEqual, "2 of 2 security groups failed")
+				So(r.Groups[0].ErrorMessage, ShouldEqual, "Security Group name invalid")
+				So(r.Groups[1].SecurityGroupName, ShouldEqual, "db")
+				So(r.Groups[1].ErrorMessage, ShouldEqual, "Security Group must contain rules")
+				So(string(msg.Data), ShouldNotContainSubstring, "token")
+			})
+
+			Reset(func() {
+				sub.Unsubscribe()
+				for len(errored) > 0 {
+					<-errored
+				}
+			})
+		})
+
+		Convey("When batch concurrency is not positive", func() {
+			batchErrored := make(chan *nats.Msg, 1)
+			sub, _ := nc.ChanSubscribe("firewall.batch.aws.error", batchErrored)
+
+			batchConcurrency = 0
+			b.Groups[0].SecurityGroupName = ""
+			b.Groups[1].SecurityGroupName = ""
+			data, _ := json.Marshal(b)
+			go batchEventHandler(&nats.Msg{Data: data})
+
+			Convey("It should still apply the groups one at a time", func() {
+				_, timeout := waitMsg(batchErrored)
+				So(timeout, ShouldBeNil)
+			})
+
+			Reset(func() {
+				batchConcurrency = 4
+				sub.Unsubscribe()
+				for len(errored) > 0 {
+					<-errored
+				}
+			})
+		})
+	})
+}
@@ -0,0 +1,252 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats"
+	"gopkg.in/yaml.v2"
+)
+
+// cidrGroupPrefix marks a rule ip naming a cidr group instead of a cidr
+const cidrGroupPrefix = "@"
+
+var (
+	ErrCIDRGroupInvalid     = errors.New("CIDR group name invalid")
+	ErrCIDRGroupCIDRInvalid = errors.New("CIDR group cidr invalid")
+	ErrCIDRGroupNotFound    = errors.New("CIDR group not found")
+	ErrCIDRGroupEmpty       = errors.New("CIDR group must contain cidrs")
+	ErrCIDRGroupInUse       = errors.New("CIDR group is still referenced by security groups")
+
+	cidrGroups     = newCIDRGroupSet()
+	cidrGroupsFile string
+)
+
+// cidrGroupSet holds the named lists of cidrs rules can reference
+type cidrGroupSet struct {
+	mu     sync.RWMutex
+	groups map[string][]string
+}
+
+// cidrGroupUpdate announces a cidr group changed. The group is reloaded
+// from the configuration when no cidrs are given.
+type cidrGroupUpdate struct {
+	Name  string   `json:"name"`
+	CIDRs []string `json:"cidrs,omitempty"`
+}
+
+func newCIDRGroupSet() *cidrGroupSet {
+	return &cidrGroupSet{groups: make(map[string][]string)}
+}
+
+func (s *cidrGroupSet) get(name string) ([]string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cidrs, ok := s.groups[name]
+	return cidrs, ok
+}
+
+func (s *cidrGroupSet) set(name string, cidrs []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.groups[name] = cidrs
+}
+
+func (s *cidrGroupSet) replace(groups map[string][]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.groups = groups
+	if s.groups == nil {
+		s.groups = make(map[string][]string)
+	}
+}
+
+// cidrGroupName returns the group an ip references, if it does
+func cidrGroupName(ip string) (string, bool) {
+	if !strings.HasPrefix(ip, cidrGroupPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(ip, cidrGroupPrefix), true
+}
+
+// resolveIP maps an ip to the cidrs it stands for
+func resolveIP(ip string) []string {
+	name, ok := cidrGroupName(ip)
+	if !ok {
+		return []string{ip}
+	}
+
+	cidrs, _ := cidrGroups.get(name)
+	return cidrs
+}
+
+// loadCIDRGroups reads the cidr groups from a yaml file, or from the
+// ernest config service when no file is given
+func loadCIDRGroups(path string) (map[string][]string, error) {
+	var data []byte
+	var err error
+
+	if path != "" {
+		data, err = ioutil.ReadFile(path)
+	} else {
+		data, err = cidrGroupsConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var groups map[string][]string
+	if err = yaml.Unmarshal(data, &groups); err != nil {
+		return nil, err
+	}
+
+	for _, cidrs := range groups {
+		if err = validateCIDRs(cidrs); err != nil {
+			return nil, err
+		}
+	}
+
+	return groups, nil
+}
+
+func validateCIDRs(cidrs []string) error {
+	if len(cidrs) < 1 {
+		return ErrCIDRGroupEmpty
+	}
+	for _, cidr := range cidrs {
+		if _, err := parseNetwork(cidr); err != nil {
+			return ErrCIDRGroupCIDRInvalid
+		}
+	}
+	return nil
+}
+
+func cidrGroupsConfig() ([]byte, error) {
+	if nc == nil {
+		return nil, nil
+	}
+
+	msg, err := nc.Request("config.get.cidr_groups", nil, time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg.Data, nil
+}
+
+// configureCIDRGroups loads the cidr groups on start. A missing file is an
+// error, while groups missing from the config service are only logged, as
+// most deployments don't declare any.
+func configureCIDRGroups(path string) error {
+	cidrGroupsFile = path
+
+	groups, err := loadCIDRGroups(path)
+	if err != nil && path != "" {
+		return err
+	}
+	if err != nil {
+		logger.WithError(err).Warn("could not load cidr groups from the config service")
+		return nil
+	}
+
+	cidrGroups.replace(groups)
+
+	return nil
+}
+
+// cidrGroupNames returns the cidr groups the event's rules reference
+func (ev *Event) cidrGroupNames() []string {
+	var names []string
+
+	rules := append(append([]rule{}, ev.SecurityGroupRules.Ingress...), ev.SecurityGroupRules.Egress...)
+	for _, r := range rules {
+		for _, ip := range append([]string{r.IP}, r.IPs...) {
+			if name, ok := cidrGroupName(ip); ok {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+// usesCIDRGroup checks if any of the event's rules reference a cidr group
+func (ev *Event) usesCIDRGroup(name string) bool {
+	for _, n := range ev.cidrGroupNames() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// updateCIDRGroup sets the group to the update's cidrs, or reloads every
+// group when none are given. Reloads dropping the group, or any group an
+// applied security group references, are refused, as the rules
+// referencing it would be revoked.
+func updateCIDRGroup(u cidrGroupUpdate) error {
+	if u.Name == "" {
+		return ErrCIDRGroupInvalid
+	}
+
+	if len(u.CIDRs) > 0 {
+		if err := validateCIDRs(u.CIDRs); err != nil {
+			return err
+		}
+		cidrGroups.set(u.Name, u.CIDRs)
+		return nil
+	}
+
+	groups, err := loadCIDRGroups(cidrGroupsFile)
+	if err != nil {
+		return err
+	}
+	if _, ok := groups[u.Name]; !ok {
+		return ErrCIDRGroupNotFound
+	}
+	for _, ev := range rc.applied() {
+		for _, name := range ev.cidrGroupNames() {
+			if _, ok := groups[name]; !ok {
+				return ErrCIDRGroupInUse
+			}
+		}
+	}
+	cidrGroups.replace(groups)
+
+	return nil
+}
+
+// cidrGroupEventHandler updates a cidr group and re-applies every stored
+// security group referencing it
+func cidrGroupEventHandler(m *nats.Msg) {
+	var u cidrGroupUpdate
+
+	err := json.Unmarshal(m.Data, &u)
+	if err == nil {
+		err = updateCIDRGroup(u)
+	}
+	if err != nil {
+		logger.WithError(err).WithField("cidr_group", u.Name).Error("could not update cidr group")
+		publish("cidr_group.update.aws.error", m.Data)
+		return
+	}
+
+	for _, ev := range rc.applied() {
+		if ev.usesCIDRGroup(u.Name) {
+			rc.reapply(ev)
+		}
+	}
+
+	publish("cidr_group.update.aws.done", m.Data)
+}
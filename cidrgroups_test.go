@@ -0,0 +1,178 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/nats-io/nats"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testCIDRGroups = `
+office: [10.1.0.0/16, 10.2.0.0/16]
+vpn: [172.16.0.0/12]
+`
+
+func TestCIDRGroups(t *testing.T) {
+	_, errored := testSetup()
+
+	Convey("Given cidr groups", t, func() {
+		dir, _ := ioutil.TempDir("", "cidrgroups")
+		err := configureCIDRGroups(writeTestPolicy(dir, "groups.yml", testCIDRGroups))
+		So(err, ShouldBeNil)
+
+		ev := testEvent
+		buildTestRules(&ev)
+		ev.SecurityGroupRules.Ingress[0].IP = "@office"
+
+		Convey("When expanding a rule referencing a group", func() {
+			expanded := expandRules(ev.SecurityGroupRules.Ingress)
+			Convey("It should produce a rule per cidr of the group", func() {
+				So(len(expanded), ShouldEqual, 2)
+				So(expanded[0].IP, ShouldEqual, "10.1.0.0/16")
+				So(expanded[1].IP, ShouldEqual, "10.2.0.0/16")
+				So(expanded[1].FromPort, ShouldEqual, 80)
+			})
+		})
+
+		Convey("When validating an event referencing a known group", func() {
+			Convey("It should not error", func() {
+				So(ev.Validate(), ShouldBeNil)
+			})
+		})
+
+		Convey("When validating an event referencing an unknown group", func() {
+			ev.SecurityGroupRules.Egress[0].IPs = []string{"@monitoring"}
+			Convey("It should error", func() {
+				So(ev.Validate(), ShouldEqual, ErrSGRuleCIDRGroupInvalid)
+			})
+		})
+
+		Convey("When checking which groups an event uses", func() {
+			Convey("It should only match referenced groups", func() {
+				So(ev.usesCIDRGroup("office"), ShouldBeTrue)
+				So(ev.usesCIDRGroup("vpn"), ShouldBeFalse)
+			})
+		})
+
+		Convey("When the file is missing", func() {
+			err := configureCIDRGroups(dir + "/missing.yml")
+			Convey("It should error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When a group is updated", func() {
+			rc = newReconciler(0, 0)
+			done := make(chan *nats.Msg, 1)
+			sub, _ := nc.ChanSubscribe("cidr_group.update.aws.done", done)
+
+			cidrGroupEventHandler(&nats.Msg{Data: []byte(`{"name": "vpn", "cidrs": ["192.168.0.0/16"]}`)})
+
+			Convey("It should use the new cidrs", func() {
+				_, timeout := waitMsg(done)
+				So(timeout, ShouldBeNil)
+				cidrs, _ := cidrGroups.get("vpn")
+				So(cidrs, ShouldResemble, []string{"192.168.0.0/16"})
+			})
+
+			Reset(func() {
+				sub.Unsubscribe()
+			})
+		})
+
+		Convey("When a group update has an invalid cidr", func() {
+			err := updateCIDRGroup(cidrGroupUpdate{Name: "vpn", CIDRs: []string{"192.168.0.0"}})
+			Convey("It should error and keep the group", func() {
+				So(err, ShouldEqual, ErrCIDRGroupCIDRInvalid)
+				cidrs, _ := cidrGroups.get("vpn")
+				So(cidrs, ShouldResemble, []string{"172.16.0.0/12"})
+			})
+		})
+
+		Convey("When a group is reloaded but no longer declared", func() {
+			rc = newReconciler(0, 0)
+			err := updateCIDRGroup(cidrGroupUpdate{Name: "monitoring"})
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrCIDRGroupNotFound)
+			})
+		})
+
+		Convey("When a reload drops a group an applied event references", func() {
+			rc = newReconciler(0, 0)
+			rc.store(ev)
+			writeTestPolicy(dir, "groups.yml", "vpn: [172.16.0.0/12]")
+			err := updateCIDRGroup(cidrGroupUpdate{Name: "vpn"})
+			Convey("It should error and keep the groups", func() {
+				So(err, ShouldEqual, ErrCIDRGroupInUse)
+				cidrs, _ := cidrGroups.get("office")
+				So(cidrs, ShouldResemble, []string{"10.1.0.0/16", "10.2.0.0/16"})
+			})
+		})
+
+		Convey("When the file holds an invalid cidr", func() {
+			err := configureCIDRGroups(writeTestPolicy(dir, "invalid.yml", "office: [10.1.0.0]"))
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrCIDRGroupCIDRInvalid)
+			})
+		})
+
+		Convey("When the file holds an empty group", func() {
+			err := configureCIDRGroups(writeTestPolicy(dir, "empty.yml", "office: []"))
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrCIDRGroupEmpty)
+			})
+		})
+
+		Convey("When a group holds ipv6 cidrs", func() {
+			cidrGroups.set("office", []string{"10.1.0.0/16", "2001:db8::/32"})
+			expanded := expandRules(ev.SecurityGroupRules.Ingress)
+			Convey("It should expand them as ipv6 rules", func() {
+				So(len(expanded), ShouldEqual, 2)
+				So(expanded[0].IP, ShouldEqual, "10.1.0.0/16")
+				So(expanded[0].IPv6, ShouldEqual, "")
+				So(expanded[1].IP, ShouldEqual, "")
+				So(expanded[1].IPv6, ShouldEqual, "2001:db8::/32")
+				perms := buildPermissions(expanded)
+				So(len(perms[0].Ipv6Ranges)+len(perms[1].Ipv6Ranges), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When re-applying an event referencing an unknown group", func() {
+			rc = newReconciler(0, 0)
+			ev.SecurityGroupRules.Ingress[0].IP = "@monitoring"
+			rc.reapply(ev)
+			Convey("It should error without changing the group", func() {
+				msg, timeout := waitMsg(errored)
+				So(timeout, ShouldBeNil)
+				So(string(msg.Data), ShouldContainSubstring, ErrSGRuleCIDRGroupInvalid.Error())
+			})
+		})
+
+		Convey("When a group update has no name", func() {
+			errored := make(chan *nats.Msg, 1)
+			sub, _ := nc.ChanSubscribe("cidr_group.update.aws.error", errored)
+
+			cidrGroupEventHandler(&nats.Msg{Data: []byte(`{"cidrs": ["192.168.0.0/16"]}`)})
+
+			Convey("It should error", func() {
+				_, timeout := waitMsg(errored)
+				So(timeout, ShouldBeNil)
+			})
+
+			Reset(func() {
+				sub.Unsubscribe()
+			})
+		})
+
+		Reset(func() {
+			cidrGroups.replace(nil)
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -0,0 +1,314 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// exit codes of the command line mode
+const (
+	exitOK      = 0
+	exitFailed  = 1
+	exitInvalid = 2
+	exitUsage   = 3
+	exitChanges = 4
+)
+
+const usage = `usage: firewall-updater-aws-connector <command> [file]
+       firewall-updater-aws-connector export -region <region> [-vpc <id>] [-groups <ids>] [-credentials]
+
+Reads a firewall.update.aws event from file, or stdin when no file or "-"
+is given, and runs it without nats.
+
+commands:
+  validate  check the event is valid and complies with the POLICY_FILE
+  plan      print the rules that applying the event would revoke (-) and
+            authorize (+), exiting with 4 when there are changes
+  apply     apply the event and print the resulting event
+  export    print the live security groups as firewall.update.aws events,
+            one per line, using the AWS_ACCESS_KEY_ID and
+            AWS_SECRET_ACCESS_KEY credentials
+
+exit codes:
+  0  success
+  1  the event could not be read or applied
+  2  the event is invalid
+  3  usage error
+  4  plan found changes
+`
+
+func runCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) > 0 && args[0] == "export" {
+		return export(args[1:], stdout, stderr)
+	}
+
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "validate", "plan", "apply":
+	default:
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+
+	err := configureLogger(os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"))
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitUsage
+	}
+	logger.Out = stderr
+
+	path := "-"
+	if len(args) == 2 {
+		path = args[1]
+	}
+
+	data, err := readInput(path, stdin)
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitFailed
+	}
+
+	var ev Event
+
+	if err = ev.Process(data); err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitInvalid
+	}
+
+	if err = loadServices(os.Getenv("SERVICES_FILE")); err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitFailed
+	}
+
+	if err = configureCIDRGroups(os.Getenv("CIDR_GROUPS_FILE")); err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitFailed
+	}
+
+	configureManagedRules(os.Getenv("MANAGED_RULE_PREFIX"))
+
+	if err = ev.Validate(); err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitInvalid
+	}
+
+	policy, err = loadPolicy(os.Getenv("POLICY_FILE"))
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitFailed
+	}
+
+	if err = policy.Evaluate(&ev); err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitInvalid
+	}
+
+	ev.analyze()
+	for _, w := range ev.Warnings {
+		fmt.Fprintln(stderr, "warning: "+w.String())
+	}
+
+	maxIngressRules = intFromEnv("MAX_INGRESS_RULES", maxIngressRules)
+	maxEgressRules = intFromEnv("MAX_EGRESS_RULES", maxEgressRules)
+	configureTags(os.Getenv("OWNERSHIP_TAG"), os.Getenv("PROTECTED_TAG"))
+
+	switch args[0] {
+	case "plan":
+		return plan(&ev, stdout, stderr)
+	case "apply":
+		return apply(&ev, stdout, stderr)
+	}
+
+	fmt.Fprintln(stdout, "event is valid")
+
+	return exitOK
+}
+
+func readInput(path string, stdin io.Reader) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(stdin)
+	}
+	return ioutil.ReadFile(path)
+}
+
+func plan(ev *Event, stdout, stderr io.Writer) int {
+	d, err := planFirewall(context.Background(), ev)
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitFailed
+	}
+
+	printDrift(stdout, d)
+
+	if d.Detected() {
+		return exitChanges
+	}
+
+	return exitOK
+}
+
+// planFirewall returns the changes applying the event would make, failing
+// as applying it would when the group is not owned or would exceed its
+// quotas
+func planFirewall(ctx context.Context, ev *Event) (*Drift, error) {
+	sg, d, err := driftedGroup(ctx, ev)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = verifyOwnership(sg); err != nil {
+		return nil, err
+	}
+
+	err = checkQuotas(ev, sg,
+		buildPermissions(d.Ingress.Extra), buildPermissions(d.Ingress.Missing),
+		buildPermissions(d.Egress.Extra), buildPermissions(d.Egress.Missing))
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func apply(ev *Event, stdout, stderr io.Writer) int {
+	var err error
+
+	audit, err = configureAudit(os.Getenv("AUDIT_FILE"), "")
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitFailed
+	}
+
+	if err = updateFirewall(context.Background(), ev); err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitFailed
+	}
+
+	data, err := json.MarshalIndent(ev, "", "  ")
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitFailed
+	}
+
+	fmt.Fprintln(stdout, string(data))
+
+	return exitOK
+}
+
+func export(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	region := fs.String("region", "", "region of the security groups")
+	vpc := fs.String("vpc", "", "only export the security groups of this vpc")
+	groups := fs.String("groups", "", "comma separated ids of the security groups to export")
+	withCredentials := fs.Bool("credentials", false, "include the credentials in the exported events")
+
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	template := Event{
+		ProviderType:          "aws",
+		DatacenterRegion:      *region,
+		DatacenterAccessKey:   os.Getenv("AWS_ACCESS_KEY_ID"),
+		DatacenterAccessToken: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}
+
+	if template.DatacenterRegion == "" {
+		fmt.Fprintln(stderr, ErrDatacenterRegionInvalid.Error())
+		return exitUsage
+	}
+
+	if template.DatacenterAccessKey == "" || template.DatacenterAccessToken == "" {
+		fmt.Fprintln(stderr, ErrDatacenterCredentialsInvalid.Error())
+		return exitUsage
+	}
+
+	svc := ec2Client(&template)
+
+	if !*withCredentials {
+		template.DatacenterAccessKey = ""
+		template.DatacenterAccessToken = ""
+	}
+
+	req := ec2.DescribeSecurityGroupsInput{Filters: exportFilters(*vpc, *groups)}
+	enc := json.NewEncoder(stdout)
+
+	err := svc.DescribeSecurityGroupsPages(&req, func(page *ec2.DescribeSecurityGroupsOutput, last bool) bool {
+		for _, sg := range page.SecurityGroups {
+			ev := template
+			describeEvent(&ev, sg)
+			if err := enc.Encode(ev); err != nil {
+				fmt.Fprintln(stderr, err.Error())
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		fmt.Fprintln(stderr, err.Error())
+		return exitFailed
+	}
+
+	return exitOK
+}
+
+func exportFilters(vpc, groups string) []*ec2.Filter {
+	var filters []*ec2.Filter
+
+	if vpc != "" {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("vpc-id"),
+			Values: []*string{aws.String(vpc)},
+		})
+	}
+
+	if groups != "" {
+		filters = append(filters, &ec2.Filter{
+			Name:   aws.String("group-id"),
+			Values: aws.StringSlice(strings.Split(groups, ",")),
+		})
+	}
+
+	return filters
+}
+
+func printDrift(w io.Writer, d *Drift) {
+	if !d.Detected() {
+		fmt.Fprintln(w, "no changes")
+		return
+	}
+
+	printRules(w, "-", "ingress", d.Ingress.Extra)
+	printRules(w, "-", "egress", d.Egress.Extra)
+	printRules(w, "+", "ingress", d.Ingress.Missing)
+	printRules(w, "+", "egress", d.Egress.Missing)
+}
+
+func printRules(w io.Writer, sign, direction string, rules []rule) {
+	for _, r := range rules {
+		ports := strconv.FormatInt(r.FromPort, 10)
+		if r.ToPort != r.FromPort {
+			ports += "-" + strconv.FormatInt(r.ToPort, 10)
+		}
+		fmt.Fprintf(w, "%s %-7s %-4s %-11s %s\n", sign, direction, r.Protocol, ports, r.source())
+	}
+}
@@ -0,0 +1,246 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCLI(t *testing.T) {
+	ev := testEvent
+	buildTestRules(&ev)
+	valid, _ := json.Marshal(ev)
+
+	Convey("Given the command line", t, func() {
+		var stdout, stderr bytes.Buffer
+
+		Convey("When running an unknown command", func() {
+			code := runCLI([]string{"destroy"}, strings.NewReader(""), &stdout, &stderr)
+			Convey("It should print the usage", func() {
+				So(code, ShouldEqual, exitUsage)
+				So(stderr.String(), ShouldContainSubstring, "usage:")
+			})
+		})
+
+		Convey("When validating a valid event from stdin", func() {
+			code := runCLI([]string{"validate"}, bytes.NewReader(valid), &stdout, &stderr)
+			Convey("It should succeed", func() {
+				So(code, ShouldEqual, exitOK)
+				So(stdout.String(), ShouldEqual, "event is valid\n")
+			})
+		})
+
+		Convey("When validating a valid event from a file", func() {
+			dir, _ := ioutil.TempDir("", "cli")
+			path := filepath.Join(dir, "event.json")
+			ioutil.WriteFile(path, valid, 0600)
+			code := runCLI([]string{"validate", path}, strings.NewReader(""), &stdout, &stderr)
+			os.RemoveAll(dir)
+			Convey("It should succeed", func() {
+				So(code, ShouldEqual, exitOK)
+			})
+		})
+
+		Convey("When validating a missing file", func() {
+			code := runCLI([]string{"validate", "/nonexistent/event.json"}, strings.NewReader(""), &stdout, &stderr)
+			Convey("It should fail", func() {
+				So(code, ShouldEqual, exitFailed)
+			})
+		})
+
+		Convey("When validating malformed json", func() {
+			code := runCLI([]string{"validate", "-"}, strings.NewReader("{"), &stdout, &stderr)
+			Convey("It should report the event as invalid", func() {
+				So(code, ShouldEqual, exitInvalid)
+			})
+		})
+
+		Convey("When validating an invalid event", func() {
+			invalid := ev
+			invalid.VPCID = ""
+			data, _ := json.Marshal(invalid)
+			code := runCLI([]string{"validate"}, bytes.NewReader(data), &stdout, &stderr)
+			Convey("It should report the validation error", func() {
+				So(code, ShouldEqual, exitInvalid)
+				So(stderr.String(), ShouldContainSubstring, "Datacenter VPC ID invalid")
+			})
+		})
+
+		Convey("When printing a plan", func() {
+			d := Drift{}
+			d.Ingress.Extra = []rule{rule{IP: "10.0.0.1/32", FromPort: 22, ToPort: 22, Protocol: "tcp"}}
+			d.Egress.Missing = []rule{rule{IP: "8.8.8.8/32", FromPort: 80, ToPort: 8080, Protocol: "tcp"}}
+			printDrift(&stdout, &d)
+			Convey("It should list the rules to revoke and authorize", func() {
+				lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+				So(len(lines), ShouldEqual, 2)
+				So(lines[0], ShouldStartWith, "- ingress")
+				So(lines[0], ShouldEndWith, "22          10.0.0.1/32")
+				So(lines[1], ShouldStartWith, "+ egress")
+				So(lines[1], ShouldContainSubstring, "80-8080")
+			})
+		})
+
+		Convey("When printing an empty plan", func() {
+			printDrift(&stdout, &Drift{})
+			Convey("It should report no changes", func() {
+				So(stdout.String(), ShouldEqual, "no changes\n")
+			})
+		})
+
+		Convey("When exporting without a region", func() {
+			code := runCLI([]string{"export"}, strings.NewReader(""), &stdout, &stderr)
+			Convey("It should report the missing region", func() {
+				So(code, ShouldEqual, exitUsage)
+				So(stderr.String(), ShouldContainSubstring, "Datacenter Region invalid")
+			})
+		})
+
+		Convey("When filtering the groups to export", func() {
+			filters := exportFilters("vpc-0000000", "sg-0000000,sg-1111111")
+			Convey("It should filter by vpc and group ids", func() {
+				So(len(filters), ShouldEqual, 2)
+				So(*filters[0].Name, ShouldEqual, "vpc-id")
+				So(*filters[0].Values[0], ShouldEqual, "vpc-0000000")
+				So(*filters[1].Name, ShouldEqual, "group-id")
+				So(len(filters[1].Values), ShouldEqual, 2)
+				So(*filters[1].Values[1], ShouldEqual, "sg-1111111")
+			})
+		})
+
+		Convey("When exporting a security group as an event", func() {
+			sg := ec2.SecurityGroup{
+				GroupId:             aws.String("sg-0000000"),
+				GroupName:           aws.String("test"),
+				VpcId:               aws.String("vpc-0000000"),
+				IpPermissions:       buildPermissions(ev.SecurityGroupRules.Ingress),
+				IpPermissionsEgress: buildPermissions(ev.SecurityGroupRules.Egress),
+			}
+			exported := Event{
+				DatacenterRegion:      "eu-west-1",
+				DatacenterAccessKey:   "key",
+				DatacenterAccessToken: "token",
+			}
+			describeEvent(&exported, &sg)
+			data, _ := json.Marshal(exported)
+			code := runCLI([]string{"validate"}, bytes.NewReader(data), &stdout, &stderr)
+			Convey("It should be accepted as an update event", func() {
+				So(code, ShouldEqual, exitOK)
+				So(exported.SecurityGroupAWSID, ShouldEqual, "sg-0000000")
+				So(exported.SecurityGroupRules, ShouldResemble, ev.SecurityGroupRules)
+			})
+		})
+
+		Convey("When exporting a security group with icmp rules", func() {
+			os.Setenv("AWS_ACCESS_KEY_ID", "key")
+			os.Setenv("AWS_SECRET_ACCESS_KEY", "token")
+			icmp := []*ec2.IpPermission{
+				&ec2.IpPermission{
+					FromPort:   aws.Int64(-1),
+					ToPort:     aws.Int64(-1),
+					IpProtocol: aws.String("icmp"),
+					IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("10.0.0.0/16")}},
+				},
+				&ec2.IpPermission{
+					FromPort:   aws.Int64(3),
+					ToPort:     aws.Int64(-1),
+					IpProtocol: aws.String("icmp"),
+					IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("0.0.0.0/0")}},
+				},
+			}
+			sg := ec2.SecurityGroup{
+				GroupId:             aws.String("sg-0000000"),
+				GroupName:           aws.String("test"),
+				VpcId:               aws.String("vpc-0000000"),
+				IpPermissions:       icmp,
+				IpPermissionsEgress: buildPermissions(ev.SecurityGroupRules.Egress),
+			}
+			restore := useTestEC2Client(&ev, testEC2Client(func(r *request.Request) {
+				r.Data.(*ec2.DescribeSecurityGroupsOutput).SecurityGroups = []*ec2.SecurityGroup{&sg}
+			}))
+
+			code := runCLI([]string{"export", "-region", "eu-west-1", "-credentials"}, strings.NewReader(""), &stdout, &stderr)
+			exported := stdout.Bytes()
+			So(code, ShouldEqual, exitOK)
+
+			Convey("It should be accepted as an update event", func() {
+				var out bytes.Buffer
+				code := runCLI([]string{"validate"}, bytes.NewReader(exported), &out, &stderr)
+				So(code, ShouldEqual, exitOK)
+				var e Event
+				json.Unmarshal(exported, &e)
+				So(buildPermissions(e.SecurityGroupRules.Ingress), ShouldResemble, icmp)
+			})
+
+			Reset(func() {
+				restore()
+				os.Unsetenv("AWS_ACCESS_KEY_ID")
+				os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+			})
+		})
+
+		Reset(func() {
+			logger.Out = os.Stderr
+		})
+	})
+}
+
+func TestPlanFirewall(t *testing.T) {
+	Convey("Given an event for a live group", t, func() {
+		ev := testEvent
+		buildTestRules(&ev)
+
+		live := ec2.SecurityGroup{
+			GroupId:             aws.String(ev.SecurityGroupAWSID),
+			GroupName:           aws.String(ev.SecurityGroupName),
+			VpcId:               aws.String(ev.VPCID),
+			IpPermissionsEgress: buildPermissions(ev.SecurityGroupRules.Egress),
+		}
+		restore := useTestEC2Client(&ev, testEC2Client(func(r *request.Request) {
+			if r.Operation.Name == "DescribeSecurityGroups" {
+				r.Data.(*ec2.DescribeSecurityGroupsOutput).SecurityGroups = []*ec2.SecurityGroup{&live}
+			}
+		}))
+
+		Convey("When the group can be updated", func() {
+			d, err := planFirewall(context.Background(), &ev)
+			Convey("It should report the changes", func() {
+				So(err, ShouldBeNil)
+				So(len(d.Ingress.Missing), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When the group is protected", func() {
+			live.Tags = []*ec2.Tag{&ec2.Tag{Key: aws.String(protectedTagKey), Value: aws.String("true")}}
+			_, err := planFirewall(context.Background(), &ev)
+			Convey("It should fail as applying would", func() {
+				So(err, ShouldEqual, ErrSGProtected)
+			})
+		})
+
+		Convey("When the changes exceed the quotas", func() {
+			ev.MaxIngressRules = 1
+			ev.SecurityGroupRules.Ingress = append(ev.SecurityGroupRules.Ingress, rule{IP: "10.0.0.0/16", FromPort: 22, ToPort: 22, Protocol: "tcp"})
+			_, err := planFirewall(context.Background(), &ev)
+			Convey("It should fail as applying would", func() {
+				So(err, ShouldEqual, ErrSGIngressQuotaExceeded)
+			})
+		})
+
+		Reset(restore)
+	})
+}
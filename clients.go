@@ -0,0 +1,113 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+var clients = newClientCache(15*time.Minute, 100)
+
+// clientCache reuses ec2 clients across events for the same region and
+// credentials, for up to ttl and keeping at most size clients
+type clientCache struct {
+	ttl     time.Duration
+	size    int
+	mu      sync.Mutex
+	clients map[string]cachedClient
+	// secret keying the credentials hash, so cache keys can't be matched
+	// against known credentials
+	secret []byte
+	now    func() time.Time
+}
+
+type cachedClient struct {
+	svc     *ec2.EC2
+	expires time.Time
+}
+
+func newClientCache(ttl time.Duration, size int) *clientCache {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+
+	return &clientCache{
+		ttl:     ttl,
+		size:    size,
+		clients: make(map[string]cachedClient),
+		secret:  secret,
+		now:     time.Now,
+	}
+}
+
+// key identifies a region and credentials without holding the credentials
+func (c *clientCache) key(ev *Event) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(ev.DatacenterAccessKey))
+	mac.Write([]byte{0})
+	mac.Write([]byte(ev.DatacenterAccessToken))
+
+	return ev.DatacenterRegion + ":" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// get returns the cached client for the event's region and credentials,
+// creating it when missing or expired
+func (c *clientCache) get(ev *Event) *ec2.EC2 {
+	if c.ttl <= 0 || c.size <= 0 {
+		return newEC2Client(ev)
+	}
+
+	key := c.key(ev)
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.clients[key]; ok && now.Before(cached.expires) {
+		return cached.svc
+	}
+
+	c.evict(now)
+
+	svc := newEC2Client(ev)
+	c.clients[key] = cachedClient{svc: svc, expires: now.Add(c.ttl)}
+
+	return svc
+}
+
+// evict drops the expired clients, and the ones closest to expiring until
+// there is room for a new client
+func (c *clientCache) evict(now time.Time) {
+	for key, cached := range c.clients {
+		if !now.Before(cached.expires) {
+			delete(c.clients, key)
+		}
+	}
+
+	for len(c.clients) >= c.size {
+		var oldest string
+		for key, cached := range c.clients {
+			if oldest == "" || cached.expires.Before(c.clients[oldest].expires) {
+				oldest = key
+			}
+		}
+		delete(c.clients, oldest)
+	}
+}
+
+func (c *clientCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.clients)
+}
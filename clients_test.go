@@ -0,0 +1,105 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClientCache(t *testing.T) {
+	Convey("Given a client cache", t, func() {
+		now := time.Now()
+		c := newClientCache(time.Minute, 2)
+		c.now = func() time.Time { return now }
+
+		ev := testEvent
+		ev.DatacenterAccessKey = "key"
+		ev.DatacenterAccessToken = "token"
+
+		Convey("When getting a client twice", func() {
+			svc := c.get(&ev)
+			Convey("It should reuse the client", func() {
+				So(c.get(&ev), ShouldEqual, svc)
+				So(c.len(), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When the credentials change", func() {
+			svc := c.get(&ev)
+			other := ev
+			other.DatacenterAccessToken = "other"
+			Convey("It should use another client", func() {
+				So(c.get(&other), ShouldNotEqual, svc)
+				So(c.len(), ShouldEqual, 2)
+			})
+		})
+
+		Convey("When the client expired", func() {
+			svc := c.get(&ev)
+			now = now.Add(time.Minute)
+			Convey("It should create a new client", func() {
+				So(c.get(&ev), ShouldNotEqual, svc)
+				So(c.len(), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When the cache is full", func() {
+			first := ev
+			first.DatacenterRegion = "us-east-1"
+			c.get(&first)
+			now = now.Add(time.Second)
+			c.get(&ev)
+			now = now.Add(time.Second)
+			third := ev
+			third.DatacenterRegion = "eu-central-1"
+			c.get(&third)
+			Convey("It should evict the client closest to expiring", func() {
+				So(c.len(), ShouldEqual, 2)
+				_, ok := c.clients[c.key(&first)]
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When computing a cache key", func() {
+			key := c.key(&ev)
+			Convey("It should not hold the credentials", func() {
+				So(key, ShouldStartWith, ev.DatacenterRegion+":")
+				So(strings.Contains(key, "key"), ShouldBeFalse)
+				So(strings.Contains(key, "token"), ShouldBeFalse)
+			})
+		})
+
+		Convey("When caching is disabled", func() {
+			c.ttl = 0
+			Convey("It should always create a new client", func() {
+				So(c.get(&ev), ShouldNotEqual, c.get(&ev))
+				So(c.len(), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func BenchmarkEC2Client(b *testing.B) {
+	ev := testEvent
+	ev.DatacenterAccessKey = "key"
+	ev.DatacenterAccessToken = "token"
+
+	b.Run("uncached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			newEC2Client(&ev)
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		c := newClientCache(time.Minute, 100)
+		for i := 0; i < b.N; i++ {
+			c.get(&ev)
+		}
+	})
+}
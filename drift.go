@@ -0,0 +1,128 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nats-io/nats"
+)
+
+type driftRules struct {
+	Extra   []rule `json:"extra"`
+	Missing []rule `json:"missing"`
+}
+
+// Drift stores the differences between an event and the live security group
+type Drift struct {
+	UUID               string     `json:"_uuid"`
+	BatchID            string     `json:"_batch_id"`
+	ProviderType       string     `json:"_type"`
+	SecurityGroupAWSID string     `json:"security_group_aws_id"`
+	SecurityGroupName  string     `json:"name"`
+	Ingress            driftRules `json:"ingress"`
+	Egress             driftRules `json:"egress"`
+}
+
+// Detected reports if the live security group differs from the event
+func (d *Drift) Detected() bool {
+	return len(d.Ingress.Extra) > 0 || len(d.Ingress.Missing) > 0 ||
+		len(d.Egress.Extra) > 0 || len(d.Egress.Missing) > 0
+}
+
+func checkEventHandler(m *nats.Msg) {
+	f := Event{subject: "firewall.check.aws"}
+
+	err := f.Process(m.Data)
+	if err != nil {
+		return
+	}
+
+	if err = f.Validate(); err != nil {
+		f.Error(err)
+		return
+	}
+
+	ctx, span := f.startSpan(f.context(), "firewall.check.aws")
+	defer span.End()
+	f.inject(ctx)
+
+	d, err := checkFirewall(ctx, &f)
+	if err != nil {
+		failSpan(span, err)
+		f.Error(err)
+		return
+	}
+
+	if d.Detected() {
+		data, err := json.Marshal(d)
+		if err != nil {
+			f.Error(err)
+			return
+		}
+		publish("firewall.drift.aws", data)
+	}
+
+	f.Complete()
+}
+
+func checkFirewall(ctx context.Context, ev *Event) (*Drift, error) {
+	_, d, err := driftedGroup(ctx, ev)
+	return d, err
+}
+
+// driftedGroup describes the event's live group and its drift from the event
+func driftedGroup(ctx context.Context, ev *Event) (*ec2.SecurityGroup, *Drift, error) {
+	svc := ec2Client(ev)
+
+	sg, err := securityGroup(ctx, svc, ev)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// keep the cached state in line with the live group
+	describedGroups.set(ev, sg)
+
+	if err = verifySecurityGroup(ev, sg); err != nil {
+		return nil, nil, err
+	}
+
+	_, span := ev.startSpan(ctx, "diff")
+	defer span.End()
+
+	return sg, buildDrift(ev, sg), nil
+}
+
+func buildDrift(ev *Event, sg *ec2.SecurityGroup) *Drift {
+	d := Drift{
+		UUID:               ev.UUID,
+		BatchID:            ev.BatchID,
+		ProviderType:       ev.ProviderType,
+		SecurityGroupAWSID: ev.SecurityGroupAWSID,
+		SecurityGroupName:  ev.SecurityGroupName,
+	}
+
+	ingress, egress := ev.desiredRules()
+	liveIngress, unmanagedIngress := ev.managedPermissions(localPermissions(sg, sg.IpPermissions))
+	liveEgress, unmanagedEgress := ev.managedPermissions(localPermissions(sg, sg.IpPermissionsEgress))
+
+	d.Ingress = buildDriftRules(buildPermissions(ingress), liveIngress, unmanagedIngress)
+	d.Egress = buildDriftRules(buildPermissions(egress), liveEgress, unmanagedEgress)
+
+	return &d
+}
+
+// buildDriftRules reports the rules an update would revoke as extra, and
+// the ones it would authorize as missing
+func buildDriftRules(desired, live, unmanaged []*ec2.IpPermission) driftRules {
+	revoke, authorize := diffPermissions(desired, live, unmanaged)
+
+	return driftRules{
+		Extra:   buildRules(revoke),
+		Missing: buildRules(authorize),
+	}
+}
@@ -0,0 +1,87 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDrift(t *testing.T) {
+	ev := testEvent
+	buildTestRules(&ev)
+
+	Convey("Given an event and a live security group", t, func() {
+		Convey("When the live group matches the event", func() {
+			sg := ec2.SecurityGroup{
+				IpPermissions:       buildPermissions(ev.SecurityGroupRules.Ingress),
+				IpPermissionsEgress: buildPermissions(ev.SecurityGroupRules.Egress),
+			}
+			d := buildDrift(&ev, &sg)
+			Convey("It should not detect drift", func() {
+				So(d.Detected(), ShouldBeFalse)
+			})
+		})
+
+		Convey("When the live group merges the event rules", func() {
+			merged := buildPermissions(ev.SecurityGroupRules.Ingress)
+			merged[0].IpRanges = append(merged[0].IpRanges, &ec2.IpRange{CidrIp: aws.String("10.0.10.101/32")})
+			sg := ec2.SecurityGroup{
+				IpPermissions:       merged,
+				IpPermissionsEgress: buildPermissions(ev.SecurityGroupRules.Egress),
+			}
+			d := buildDrift(&ev, &sg)
+			Convey("It should report the extra rule", func() {
+				So(d.Detected(), ShouldBeTrue)
+				So(len(d.Ingress.Extra), ShouldEqual, 1)
+				So(d.Ingress.Extra[0].IP, ShouldEqual, "10.0.10.101/32")
+				So(len(d.Ingress.Missing), ShouldEqual, 0)
+				So(len(d.Egress.Extra), ShouldEqual, 0)
+				So(len(d.Egress.Missing), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When the live group is missing a rule", func() {
+			sg := ec2.SecurityGroup{
+				IpPermissions: buildPermissions(ev.SecurityGroupRules.Ingress),
+			}
+			d := buildDrift(&ev, &sg)
+			Convey("It should report the missing rule", func() {
+				So(d.Detected(), ShouldBeTrue)
+				So(len(d.Egress.Missing), ShouldEqual, 1)
+				So(d.Egress.Missing[0].IP, ShouldEqual, "8.8.8.8/32")
+				So(len(d.Egress.Extra), ShouldEqual, 0)
+				So(len(d.Ingress.Extra), ShouldEqual, 0)
+				So(len(d.Ingress.Missing), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When the live group opens ports to another group", func() {
+			ingress := buildPermissions(ev.SecurityGroupRules.Ingress)
+			ingress = append(ingress, &ec2.IpPermission{
+				FromPort:   aws.Int64(5432),
+				ToPort:     aws.Int64(5432),
+				IpProtocol: aws.String("tcp"),
+				UserIdGroupPairs: []*ec2.UserIdGroupPair{
+					&ec2.UserIdGroupPair{GroupId: aws.String("sg-1111111"), UserId: aws.String("123456789012")},
+				},
+			})
+			sg := ec2.SecurityGroup{
+				IpPermissions:       ingress,
+				IpPermissionsEgress: buildPermissions(ev.SecurityGroupRules.Egress),
+			}
+			d := buildDrift(&ev, &sg)
+			Convey("It should report the rule the update revokes", func() {
+				So(d.Detected(), ShouldBeTrue)
+				So(len(d.Ingress.Extra), ShouldEqual, 1)
+				So(d.Ingress.Extra[0].SourceGroup, ShouldEqual, "sg-1111111")
+				So(len(d.Ingress.Missing), ShouldEqual, 0)
+			})
+		})
+	})
+}
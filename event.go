@@ -7,7 +7,7 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"log"
+	"strings"
 )
 
 var (
@@ -18,16 +18,42 @@ var (
 	ErrSGNameInvalid                = errors.New("Security Group name invalid")
 	ErrSGRulesInvalid               = errors.New("Security Group must contain rules")
 	ErrSGRuleIPInvalid              = errors.New("Security Group rule ip invalid")
+	ErrSGRuleSourceInvalid          = errors.New("Security Group rule must have a single kind of source")
 	ErrSGRuleProtocolInvalid        = errors.New("Security Group rule protocol invalid")
 	ErrSGRuleFromPortInvalid        = errors.New("Security Group rule from port invalid")
 	ErrSGRuleToPortInvalid          = errors.New("Security Group rule to port invalid")
+	ErrSGRuleServiceInvalid         = errors.New("Security Group rule service unknown")
+	ErrSGRulePortsInvalid           = errors.New("Security Group rule ports invalid")
+	ErrSGRuleCIDRGroupInvalid       = errors.New("Security Group rule cidr group unknown")
+	ErrSGNotFound                   = errors.New("Could not find security group")
+	ErrSGAmbiguous                  = errors.New("Found more than one matching security group")
+	ErrSGVPCMismatch                = errors.New("Security Group does not belong to the datacenter VPC")
+	ErrSGNameMismatch               = errors.New("Security Group name does not match")
+	ErrSGIngressQuotaExceeded       = errors.New("Security Group would exceed its inbound rules quota")
+	ErrSGEgressQuotaExceeded        = errors.New("Security Group would exceed its outbound rules quota")
+	ErrSGQuotaInvalid               = errors.New("Security Group rules quota invalid")
+	ErrSGEgressDefaultInvalid       = errors.New("Security Group egress default invalid")
+	ErrSGTagInvalid                 = errors.New("Security Group tag invalid")
+	ErrSGNotOwned                   = errors.New("Security Group is not owned by the connector")
+	ErrSGProtected                  = errors.New("Security Group is protected")
 )
 
+// rule opens ports to a single kind of source, either ipv4 cidrs, an ipv6
+// cidr, another security group or a prefix list. Groups of other accounts
+// also name their owner.
 type rule struct {
-	IP       string `json:"ip"`
-	FromPort int64  `json:"from_port"`
-	ToPort   int64  `json:"to_port"`
-	Protocol string `json:"protocol"`
+	IP               string      `json:"ip"`
+	IPs              []string    `json:"ips,omitempty"`
+	IPv6             string      `json:"ipv6,omitempty"`
+	SourceGroup      string      `json:"source_group,omitempty"`
+	SourceGroupOwner string      `json:"source_group_owner,omitempty"`
+	PrefixList       string      `json:"prefix_list,omitempty"`
+	FromPort         int64       `json:"from_port"`
+	ToPort           int64       `json:"to_port"`
+	Ports            []portRange `json:"ports,omitempty"`
+	Protocol         string      `json:"protocol"`
+	Description      string      `json:"description,omitempty"`
+	Service          string      `json:"service,omitempty"`
 }
 
 // Event stores the firewall data
@@ -46,7 +72,23 @@ type Event struct {
 		Ingress []rule `json:"ingress"`
 		Egress  []rule `json:"egress"`
 	} `json:"rules"`
-	ErrorMessage string `json:"error,omitempty"`
+	Tags              map[string]string `json:"tags,omitempty"`
+	EgressDefault     string            `json:"egress_default,omitempty"`
+	PartialManagement bool              `json:"partial_management,omitempty"`
+	UnmanagedRules    *ruleSet          `json:"unmanaged_rules,omitempty"`
+	DefaultEgressRule string            `json:"default_egress_rule,omitempty"`
+	NetworkACLRules   *aclRules         `json:"acl_rules,omitempty"`
+	Environment       string            `json:"environment,omitempty"`
+	CollapseRules     bool              `json:"collapse_rules,omitempty"`
+	MaxIngressRules   int               `json:"max_ingress_rules,omitempty"`
+	MaxEgressRules    int               `json:"max_egress_rules,omitempty"`
+	TraceContext      map[string]string `json:"_trace,omitempty"`
+	ReconcileDisabled bool              `json:"reconcile_disabled,omitempty"`
+	Reconciled        bool              `json:"reconciled,omitempty"`
+	Warnings          []RuleWarning     `json:"warnings,omitempty"`
+	Violations        []PolicyViolation `json:"violations,omitempty"`
+	ErrorMessage      string            `json:"error,omitempty"`
+	subject           string
 }
 
 // Validate checks if all criteria are met
@@ -63,48 +105,153 @@ func (ev *Event) Validate() error {
 		return ErrDatacenterCredentialsInvalid
 	}
 
-	if ev.SecurityGroupAWSID == "" {
-		return ErrSGAWSIDInvalid
-	}
-
 	if ev.SecurityGroupName == "" {
 		return ErrSGNameInvalid
 	}
 
-	if len(ev.SecurityGroupRules.Egress) < 1 && len(ev.SecurityGroupRules.Egress) < 1 {
+	if len(ev.SecurityGroupRules.Ingress) < 1 && len(ev.SecurityGroupRules.Egress) < 1 {
 		return ErrSGRulesInvalid
 	}
 
+	switch ev.EgressDefault {
+	case "", egressDefaultAllow, egressDefaultStrict:
+	default:
+		return ErrSGEgressDefaultInvalid
+	}
+
+	if ev.MaxIngressRules < 0 || ev.MaxEgressRules < 0 {
+		return ErrSGQuotaInvalid
+	}
+
+	for key := range ev.Tags {
+		if key == "" || strings.HasPrefix(key, "aws:") {
+			return ErrSGTagInvalid
+		}
+	}
+
 	for _, rule := range ev.SecurityGroupRules.Ingress {
-		if rule.IP == "" {
-			return ErrSGRuleIPInvalid
+		if err := validateRule(rule); err != nil {
+			return err
 		}
-		if rule.Protocol == "" {
-			return ErrSGRuleProtocolInvalid
+	}
+
+	for _, rule := range ev.SecurityGroupRules.Egress {
+		if err := validateRule(rule); err != nil {
+			return err
 		}
-		if rule.FromPort < 0 || rule.FromPort > 65535 {
-			return ErrSGRuleFromPortInvalid
+	}
+
+	return nil
+}
+
+func validateRule(r rule) error {
+	var sources int
+	for _, set := range []bool{r.IP != "" || len(r.IPs) > 0, r.IPv6 != "", r.SourceGroup != "", r.PrefixList != ""} {
+		if set {
+			sources++
 		}
-		if rule.ToPort < 0 || rule.ToPort > 65535 {
-			return ErrSGRuleToPortInvalid
+	}
+	if sources < 1 {
+		return ErrSGRuleIPInvalid
+	}
+	if sources > 1 {
+		return ErrSGRuleSourceInvalid
+	}
+	if r.SourceGroupOwner != "" && r.SourceGroup == "" {
+		return ErrSGRuleSourceInvalid
+	}
+	for _, ip := range r.IPs {
+		if ip == "" {
+			return ErrSGRuleIPInvalid
+		}
+	}
+	for _, ip := range append([]string{r.IP}, r.IPs...) {
+		if name, ok := cidrGroupName(ip); ok {
+			if _, ok = cidrGroups.get(name); !ok {
+				return ErrSGRuleCIDRGroupInvalid
+			}
 		}
 	}
 
-	for _, rule := range ev.SecurityGroupRules.Egress {
-		if rule.IP == "" {
-			return ErrSGRuleIPInvalid
+	if len(r.Ports) > 0 && r.Service != "" {
+		return ErrSGRulePortsInvalid
+	}
+	for _, p := range r.Ports {
+		if _, _, err := p.bounds(); err != nil {
+			return err
 		}
-		if rule.Protocol == "" {
+	}
+
+	if r.Service != "" {
+		if _, ok := services[r.Service]; !ok {
+			return ErrSGRuleServiceInvalid
+		}
+		// the service sets the protocol and ports, which rules can't change
+		if r.Protocol != "" {
 			return ErrSGRuleProtocolInvalid
 		}
-		if rule.FromPort < 0 || rule.FromPort > 65535 {
-			return ErrSGRuleFromPortInvalid
+		if r.FromPort != 0 || r.ToPort != 0 {
+			return ErrSGRulePortsInvalid
 		}
-		if rule.ToPort < 0 || rule.ToPort > 65535 {
-			return ErrSGRuleToPortInvalid
+		return nil
+	}
+
+	if r.Protocol == "" {
+		return ErrSGRuleProtocolInvalid
+	}
+
+	if len(r.Ports) > 0 {
+		return nil
+	}
+
+	// icmp rules hold a type and code, where aws describes any of them as -1
+	min, max := int64(0), int64(65535)
+	switch protocolName(r.Protocol) {
+	case "icmp", "icmpv6":
+		min, max = -1, 255
+	}
+
+	if r.FromPort < min || r.FromPort > max {
+		return ErrSGRuleFromPortInvalid
+	}
+	if r.ToPort < min || r.ToPort > max {
+		return ErrSGRuleToPortInvalid
+	}
+
+	return nil
+}
+
+// egressRules returns the egress rules the group should hold, adding the
+// default allow all rule when the event keeps it
+func (ev *Event) egressRules() []rule {
+	rules := ev.SecurityGroupRules.Egress
+	if ev.EgressDefault != egressDefaultAllow {
+		return rules
+	}
+
+	for _, r := range rules {
+		if isDefaultEgressRule(r) {
+			return rules
 		}
 	}
 
+	return append(append([]rule{}, rules...), defaultEgressRule)
+}
+
+// ValidateGet checks if the criteria to read a security group are met
+func (ev *Event) ValidateGet() error {
+	if ev.DatacenterRegion == "" {
+		return ErrDatacenterRegionInvalid
+	}
+
+	if ev.DatacenterAccessKey == "" || ev.DatacenterAccessToken == "" {
+		return ErrDatacenterCredentialsInvalid
+	}
+
+	if ev.SecurityGroupAWSID == "" {
+		return ErrSGAWSIDInvalid
+	}
+
 	return nil
 }
 
@@ -112,21 +259,25 @@ func (ev *Event) Validate() error {
 func (ev *Event) Process(data []byte) error {
 	err := json.Unmarshal(data, &ev)
 	if err != nil {
-		nc.Publish("firewall.update.aws.error", data)
+		publish(ev.subjectFor("error"), data)
 	}
 	return err
 }
 
 // Error the request
 func (ev *Event) Error(err error) {
-	log.Printf("Error: %s", err.Error())
+	ev.log(ev.topic()).WithError(err).Error("request failed")
 	ev.ErrorMessage = err.Error()
 
+	if perr, ok := err.(*PolicyError); ok {
+		ev.Violations = perr.Violations
+	}
+
 	data, err := json.Marshal(ev)
 	if err != nil {
-		log.Panic(err)
+		ev.log(ev.topic()).Panic(err)
 	}
-	nc.Publish("firewall.update.aws.error", data)
+	publish(ev.subjectFor("error"), data)
 }
 
 // Complete the request
@@ -135,5 +286,40 @@ func (ev *Event) Complete() {
 	if err != nil {
 		ev.Error(err)
 	}
-	nc.Publish("firewall.update.aws.done", data)
+	ev.log(ev.topic()).Info("request completed")
+	publish(ev.subjectFor("done"), data)
+}
+
+func (ev *Event) topic() string {
+	if ev.subject == "" {
+		return "firewall.update.aws"
+	}
+	return ev.subject
+}
+
+func (ev *Event) subjectFor(status string) string {
+	return ev.topic() + "." + status
+}
+
+// Reply to a request with the event, flagging any error
+func (ev *Event) Reply(subject string, err error) {
+	if err != nil {
+		ev.log(ev.topic()).WithError(err).Error("request failed")
+		ev.ErrorMessage = err.Error()
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		ev.log(ev.topic()).Panic(err)
+	}
+	publish(subject, data)
+}
+
+// publish sends data on a subject, unless running without nats from the
+// command line
+func publish(subject string, data []byte) {
+	if nc == nil {
+		return
+	}
+	nc.Publish(subject, data)
 }
@@ -8,7 +8,6 @@ import (
 	"encoding/json"
 	"errors"
 	"io/ioutil"
-	"log"
 	"os"
 	"testing"
 	"time"
@@ -142,7 +141,7 @@ func TestEvent(t *testing.T) {
 			})
 
 			Convey("When erroring the event", func() {
-				log.SetOutput(ioutil.Discard)
+				logger.Out = ioutil.Discard
 				var e Event
 				e.Process(valid)
 				e.Error(errors.New("error"))
@@ -155,7 +154,52 @@ func TestEvent(t *testing.T) {
 					So(msg, ShouldBeNil)
 					So(timeout, ShouldNotBeNil)
 				})
-				log.SetOutput(os.Stdout)
+				logger.Out = os.Stderr
+			})
+		})
+
+		Convey("With only the fields required to read a security group", func() {
+			testEventGet := Event{
+				DatacenterRegion:      "eu-west-1",
+				DatacenterAccessKey:   "key",
+				DatacenterAccessToken: "token",
+				SecurityGroupAWSID:    "sg-0000000",
+			}
+			data, _ := json.Marshal(testEventGet)
+
+			Convey("When validating the event for a read", func() {
+				var e Event
+				e.Process(data)
+				err := e.ValidateGet()
+				Convey("It should not error", func() {
+					So(err, ShouldBeNil)
+				})
+			})
+		})
+
+		Convey("With no security group aws id", func() {
+			testEventInvalid := testEvent
+			buildTestRules(&testEventInvalid)
+			testEventInvalid.SecurityGroupAWSID = ""
+			invalid, _ := json.Marshal(testEventInvalid)
+
+			Convey("When validating the event for a read", func() {
+				var e Event
+				e.Process(invalid)
+				err := e.ValidateGet()
+				Convey("It should error", func() {
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldEqual, "Security Group aws id invalid")
+				})
+			})
+
+			Convey("When validating the event", func() {
+				var e Event
+				e.Process(invalid)
+				err := e.Validate()
+				Convey("It should not error", func() {
+					So(err, ShouldBeNil)
+				})
 			})
 		})
 
@@ -392,5 +436,157 @@ func TestEvent(t *testing.T) {
 			})
 		})
 
+		Convey("With an invalid egress default", func() {
+			testEventInvalid := testEvent
+			buildTestRules(&testEventInvalid)
+			testEventInvalid.EgressDefault = "deny"
+			invalid, _ := json.Marshal(testEventInvalid)
+
+			Convey("When validating the event", func() {
+				var e Event
+				e.Process(invalid)
+				err := e.Validate()
+				Convey("It should error", func() {
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldEqual, "Security Group egress default invalid")
+				})
+			})
+		})
+
+		Convey("With the default egress kept", func() {
+			e := testEvent
+			buildTestRules(&e)
+			e.EgressDefault = egressDefaultAllow
+
+			Convey("It should add the allow all rule to the egress rules", func() {
+				rules := e.egressRules()
+				So(len(rules), ShouldEqual, len(e.SecurityGroupRules.Egress)+1)
+				So(rules[len(rules)-1], ShouldResemble, defaultEgressRule)
+			})
+
+			Convey("It should not add it twice", func() {
+				e.SecurityGroupRules.Egress = []rule{defaultEgressRule}
+				So(len(e.egressRules()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("With a strict egress default", func() {
+			e := testEvent
+			buildTestRules(&e)
+			e.EgressDefault = egressDefaultStrict
+
+			Convey("It should only use the listed egress rules", func() {
+				So(e.egressRules(), ShouldResemble, e.SecurityGroupRules.Egress)
+			})
+		})
+
+		Convey("With an unknown rule service", func() {
+			testEventInvalid := testEvent
+			buildTestRules(&testEventInvalid)
+			testEventInvalid.SecurityGroupRules.Ingress[0].Service = "gopher"
+			invalid, _ := json.Marshal(testEventInvalid)
+
+			Convey("When validating the event", func() {
+				var e Event
+				e.Process(invalid)
+				err := e.Validate()
+				Convey("It should error", func() {
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldEqual, "Security Group rule service unknown")
+				})
+			})
+		})
+
+		Convey("With a known rule service and no protocol", func() {
+			e := testEvent
+			buildTestRules(&e)
+			e.SecurityGroupRules.Ingress = []rule{rule{IP: "10.0.0.0/24", Service: "https"}}
+
+			Convey("It should not error", func() {
+				So(e.Validate(), ShouldBeNil)
+			})
+		})
+
+		Convey("With a rule service and a protocol", func() {
+			e := testEvent
+			buildTestRules(&e)
+			e.SecurityGroupRules.Ingress = []rule{rule{IP: "10.0.0.0/24", Service: "https", Protocol: "udp"}}
+
+			Convey("It should error", func() {
+				So(e.Validate(), ShouldEqual, ErrSGRuleProtocolInvalid)
+			})
+		})
+
+		Convey("With a rule service and a port", func() {
+			e := testEvent
+			buildTestRules(&e)
+			e.SecurityGroupRules.Ingress = []rule{rule{IP: "10.0.0.0/24", Service: "https", ToPort: 8443}}
+
+			Convey("It should error", func() {
+				So(e.Validate(), ShouldEqual, ErrSGRulePortsInvalid)
+			})
+		})
+
+		Convey("With an invalid rule port range", func() {
+			e := testEvent
+			buildTestRules(&e)
+			e.SecurityGroupRules.Ingress[0].Ports = []portRange{"22", "90-80"}
+
+			Convey("It should error", func() {
+				So(e.Validate(), ShouldEqual, ErrSGRulePortsInvalid)
+			})
+		})
+
+		Convey("With rule ips and no ip", func() {
+			e := testEvent
+			buildTestRules(&e)
+			e.SecurityGroupRules.Ingress[0].IP = ""
+			e.SecurityGroupRules.Ingress[0].IPs = []string{"10.0.0.0/24", "10.0.1.0/24"}
+
+			Convey("It should not error", func() {
+				So(e.Validate(), ShouldBeNil)
+			})
+		})
+
+		Convey("With a reserved tag", func() {
+			e := testEvent
+			buildTestRules(&e)
+			e.Tags = map[string]string{"aws:team": "web"}
+
+			Convey("It should error", func() {
+				So(e.Validate(), ShouldEqual, ErrSGTagInvalid)
+			})
+		})
+
+		Convey("With a rule with several kinds of sources", func() {
+			e := testEvent
+			buildTestRules(&e)
+			e.SecurityGroupRules.Ingress[0].SourceGroup = "sg-1111111"
+
+			Convey("It should error", func() {
+				So(e.Validate(), ShouldEqual, ErrSGRuleSourceInvalid)
+			})
+		})
+
+		Convey("With a rule opening ports to another group", func() {
+			e := testEvent
+			buildTestRules(&e)
+			e.SecurityGroupRules.Ingress[0].IP = ""
+			e.SecurityGroupRules.Ingress[0].SourceGroup = "sg-1111111"
+
+			Convey("It should not error", func() {
+				So(e.Validate(), ShouldBeNil)
+			})
+		})
+
+		Convey("With a negative rules quota", func() {
+			e := testEvent
+			buildTestRules(&e)
+			e.MaxEgressRules = -1
+
+			Convey("It should error", func() {
+				So(e.Validate(), ShouldEqual, ErrSGQuotaInvalid)
+			})
+		})
 	})
 }
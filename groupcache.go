@@ -0,0 +1,187 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// describedGroups is disabled unless DESCRIBE_CACHE_TTL is set, as changes
+// made to a group outside the connector go unnoticed while it is cached
+var describedGroups = newGroupCache(0)
+
+// groupCache keeps the described state of recently updated security
+// groups for up to ttl, so bursts of updates to a group don't describe it
+// every time. The state is updated locally after every change, without
+// extending how long it is kept.
+type groupCache struct {
+	ttl    time.Duration
+	mu     sync.Mutex
+	groups map[string]cachedGroup
+	now    func() time.Time
+}
+
+type cachedGroup struct {
+	sg      *ec2.SecurityGroup
+	expires time.Time
+}
+
+func newGroupCache(ttl time.Duration) *groupCache {
+	return &groupCache{
+		ttl:    ttl,
+		groups: make(map[string]cachedGroup),
+		now:    time.Now,
+	}
+}
+
+// key identifies a group as seen with the event's credentials, so groups
+// described with some credentials are never served to others
+func (c *groupCache) key(ev *Event) string {
+	return clients.key(ev) + ":" + ev.SecurityGroupAWSID
+}
+
+func (c *groupCache) get(ev *Event) (*ec2.SecurityGroup, bool) {
+	if c.ttl <= 0 || ev.SecurityGroupAWSID == "" {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.groups[c.key(ev)]
+	if !ok || !c.now().Before(cached.expires) {
+		return nil, false
+	}
+
+	return cached.sg, true
+}
+
+func (c *groupCache) set(ev *Event, sg *ec2.SecurityGroup) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for key, cached := range c.groups {
+		if !now.Before(cached.expires) {
+			delete(c.groups, key)
+		}
+	}
+
+	c.groups[c.key(ev)] = cachedGroup{sg: sg, expires: now.Add(c.ttl)}
+}
+
+// update replaces the state of a cached group after the connector changed
+// it, keeping its expiry so the group is still described once per ttl
+func (c *groupCache) update(ev *Event, sg *ec2.SecurityGroup) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := c.key(ev)
+	cached, ok := c.groups[key]
+	if !ok || !c.now().Before(cached.expires) {
+		return
+	}
+
+	c.groups[key] = cachedGroup{sg: sg, expires: cached.expires}
+}
+
+func (c *groupCache) invalidate(ev *Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.groups, c.key(ev))
+}
+
+// cachedSecurityGroup returns the cached state of the event's group,
+// describing it when missing, expired or when a refresh is forced
+func cachedSecurityGroup(ctx context.Context, svc *ec2.EC2, ev *Event, refresh bool) (*ec2.SecurityGroup, error) {
+	if !refresh {
+		if sg, ok := describedGroups.get(ev); ok {
+			describeCacheLookups.WithLabelValues("hit").Inc()
+			return sg, nil
+		}
+	}
+	describeCacheLookups.WithLabelValues("miss").Inc()
+
+	sg, err := securityGroup(ctx, svc, ev)
+	if err != nil {
+		return nil, err
+	}
+
+	describedGroups.set(ev, sg)
+
+	return sg, nil
+}
+
+// isConflict checks if an error means the group's state differs from the
+// one the changes were computed from
+func isConflict(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case "InvalidPermission.Duplicate", "InvalidPermission.NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+// splitPermissions splits permissions into a permission per ip range,
+// keeping the other sources of a permission together
+func splitPermissions(perms []*ec2.IpPermission) []*ec2.IpPermission {
+	var split []*ec2.IpPermission
+
+	for _, p := range perms {
+		for _, ip := range p.IpRanges {
+			split = append(split, &ec2.IpPermission{
+				FromPort:   p.FromPort,
+				ToPort:     p.ToPort,
+				IpProtocol: p.IpProtocol,
+				IpRanges:   []*ec2.IpRange{ip},
+			})
+		}
+
+		if len(p.Ipv6Ranges)+len(p.UserIdGroupPairs)+len(p.PrefixListIds) > 0 {
+			rest := *p
+			rest.IpRanges = nil
+			split = append(split, &rest)
+		}
+	}
+
+	return split
+}
+
+// applyPermissions returns the permissions a group holds once the revoked
+// and authorized permissions are applied
+func applyPermissions(live, revoke, authorize []*ec2.IpPermission) []*ec2.IpPermission {
+	applied := buildRevokePermissions(splitPermissions(live), splitPermissions(revoke))
+	return append(applied, splitPermissions(authorize)...)
+}
+
+// appliedGroup returns the state of a group once the event was applied
+func appliedGroup(sg *ec2.SecurityGroup, revokeIngress, authorizeIngress, revokeEgress, authorizeEgress []*ec2.IpPermission, tags []*ec2.Tag) *ec2.SecurityGroup {
+	applied := *sg
+	applied.IpPermissions = applyPermissions(normalizePermissions(localPermissions(sg, sg.IpPermissions)), revokeIngress, authorizeIngress)
+	applied.IpPermissionsEgress = applyPermissions(normalizePermissions(localPermissions(sg, sg.IpPermissionsEgress)), revokeEgress, authorizeEgress)
+
+	applied.Tags = nil
+	for _, t := range sg.Tags {
+		if _, ok := tagValue(tags, aws.StringValue(t.Key)); !ok {
+			applied.Tags = append(applied.Tags, t)
+		}
+	}
+	applied.Tags = append(applied.Tags, tags...)
+
+	return &applied
+}
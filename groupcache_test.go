@@ -0,0 +1,228 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testEC2Client returns a client handing its requests to send instead of
+// aws, which fills their output or error
+func testEC2Client(send func(r *request.Request)) *ec2.EC2 {
+	svc := ec2.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("key", "token", ""),
+		MaxRetries:  aws.Int(0),
+	})))
+
+	svc.Handlers.Send.Clear()
+	svc.Handlers.Send.PushBack(send)
+	svc.Handlers.ValidateResponse.Clear()
+	svc.Handlers.Unmarshal.Clear()
+	svc.Handlers.UnmarshalMeta.Clear()
+	svc.Handlers.UnmarshalError.Clear()
+
+	return svc
+}
+
+// useTestEC2Client makes the client cache return svc for the event's
+// credentials, returning a func restoring it
+func useTestEC2Client(ev *Event, svc *ec2.EC2) func() {
+	key := clients.key(ev)
+
+	clients.mu.Lock()
+	clients.clients[key] = cachedClient{svc: svc, expires: time.Now().Add(time.Hour)}
+	clients.mu.Unlock()
+
+	return func() {
+		clients.mu.Lock()
+		delete(clients.clients, key)
+		clients.mu.Unlock()
+	}
+}
+
+func TestGroupCache(t *testing.T) {
+	Convey("Given a described security group cache", t, func() {
+		now := time.Now()
+		c := newGroupCache(10 * time.Second)
+		c.now = func() time.Time { return now }
+
+		ev := testEvent
+		ev.DatacenterAccessKey = "key"
+		ev.DatacenterAccessToken = "token"
+		sg := ec2.SecurityGroup{GroupId: aws.String(ev.SecurityGroupAWSID)}
+
+		Convey("When a group was described", func() {
+			c.set(&ev, &sg)
+			Convey("It should return its state", func() {
+				cached, ok := c.get(&ev)
+				So(ok, ShouldBeTrue)
+				So(cached, ShouldEqual, &sg)
+			})
+		})
+
+		Convey("When the state expired", func() {
+			c.set(&ev, &sg)
+			now = now.Add(10 * time.Second)
+			Convey("It should miss", func() {
+				_, ok := c.get(&ev)
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When the group was updated locally", func() {
+			c.set(&ev, &sg)
+			updated := sg
+			now = now.Add(5 * time.Second)
+			c.update(&ev, &updated)
+			Convey("It should return the updated state", func() {
+				cached, ok := c.get(&ev)
+				So(ok, ShouldBeTrue)
+				So(cached, ShouldEqual, &updated)
+			})
+			Convey("It should keep the expiry of the description", func() {
+				now = now.Add(5 * time.Second)
+				_, ok := c.get(&ev)
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When a group that isn't cached was updated locally", func() {
+			c.update(&ev, &sg)
+			Convey("It should miss", func() {
+				_, ok := c.get(&ev)
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When looking the group up with other credentials", func() {
+			c.set(&ev, &sg)
+			other := ev
+			other.DatacenterAccessToken = "other"
+			Convey("It should miss", func() {
+				_, ok := c.get(&other)
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When the state was invalidated", func() {
+			c.set(&ev, &sg)
+			c.invalidate(&ev)
+			Convey("It should miss", func() {
+				_, ok := c.get(&ev)
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When caching is disabled", func() {
+			c.ttl = 0
+			c.set(&ev, &sg)
+			Convey("It should miss", func() {
+				_, ok := c.get(&ev)
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+
+	Convey("Given aws errors", t, func() {
+		Convey("It should only consider permission conflicts as conflicts", func() {
+			So(isConflict(awserr.New("InvalidPermission.Duplicate", "duplicate", nil)), ShouldBeTrue)
+			So(isConflict(awserr.New("InvalidPermission.NotFound", "not found", nil)), ShouldBeTrue)
+			So(isConflict(awserr.New("UnauthorizedOperation", "denied", nil)), ShouldBeFalse)
+			So(isConflict(errors.New("error")), ShouldBeFalse)
+			So(isConflict(nil), ShouldBeFalse)
+		})
+	})
+
+	Convey("Given a cached group missing rules added since", t, func() {
+		ev := testEvent
+		buildTestRules(&ev)
+
+		live := ec2.SecurityGroup{
+			GroupId:             aws.String(ev.SecurityGroupAWSID),
+			GroupName:           aws.String(ev.SecurityGroupName),
+			VpcId:               aws.String(ev.VPCID),
+			IpPermissions:       buildPermissions(ev.SecurityGroupRules.Ingress),
+			IpPermissionsEgress: buildPermissions(ev.SecurityGroupRules.Egress),
+		}
+		cached := live
+		cached.IpPermissions = nil
+
+		describedGroups = newGroupCache(time.Minute)
+		describedGroups.set(&ev, &cached)
+
+		calls := make(map[string]int)
+		svc := testEC2Client(func(r *request.Request) {
+			calls[r.Operation.Name]++
+			switch r.Operation.Name {
+			case "DescribeSecurityGroups":
+				r.Data.(*ec2.DescribeSecurityGroupsOutput).SecurityGroups = []*ec2.SecurityGroup{&live}
+			case "AuthorizeSecurityGroupIngress":
+				r.Error = awserr.New("InvalidPermission.Duplicate", "the rule already exists", nil)
+			}
+		})
+
+		Convey("When applying the event", func() {
+			err := applyFirewall(context.Background(), svc, &ev)
+			Convey("It should describe the group again and retry", func() {
+				So(err, ShouldBeNil)
+				So(calls["AuthorizeSecurityGroupIngress"], ShouldEqual, 1)
+				So(calls["DescribeSecurityGroups"], ShouldEqual, 1)
+				So(calls["RevokeSecurityGroupIngress"], ShouldEqual, 0)
+			})
+		})
+
+		Reset(func() {
+			describedGroups = newGroupCache(0)
+		})
+	})
+
+	Convey("Given a group holding merged rules", t, func() {
+		sg := ec2.SecurityGroup{
+			IpPermissions: testMergedRuleset,
+			Tags: []*ec2.Tag{
+				&ec2.Tag{Key: aws.String("team"), Value: aws.String("web")},
+				&ec2.Tag{Key: aws.String("env"), Value: aws.String("dev")},
+			},
+		}
+
+		Convey("When applying changes locally", func() {
+			revoke := buildPermissions([]rule{rule{IP: "10.0.10.101/32", FromPort: 80, ToPort: 8080, Protocol: "tcp"}})
+			authorize := testNewRuleset[1:]
+			tags := []*ec2.Tag{&ec2.Tag{Key: aws.String("team"), Value: aws.String("api")}}
+			applied := appliedGroup(&sg, revoke, authorize, nil, nil, tags)
+
+			Convey("It should hold the resulting rules", func() {
+				rules := buildRules(applied.IpPermissions)
+				So(len(rules), ShouldEqual, 3)
+				So(rules[0].IP, ShouldEqual, "10.0.10.100/32")
+				So(rules[1].Protocol, ShouldEqual, "-1")
+				So(rules[2].IP, ShouldEqual, "10.0.0.0/32")
+				So(countRules(applied.IpPermissions), ShouldEqual, 3)
+			})
+
+			Convey("It should hold the updated tags", func() {
+				So(buildTags(applied.Tags), ShouldResemble, map[string]string{"team": "api", "env": "dev"})
+			})
+
+			Convey("It should leave the described state untouched", func() {
+				So(len(sg.IpPermissions), ShouldEqual, 2)
+				So(len(sg.IpPermissions[0].IpRanges), ShouldEqual, 2)
+				So(*sg.Tags[0].Value, ShouldEqual, "web")
+			})
+		})
+	})
+}
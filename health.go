@@ -0,0 +1,133 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nats-io/nats"
+)
+
+var workers *pool
+var subscriptions []*nats.Subscription
+var shuttingDown int32
+
+// pool runs message handlers on a bounded number of workers
+type pool struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newPool(size int) *pool {
+	if size < 1 {
+		size = 1
+	}
+	return &pool{slots: make(chan struct{}, size)}
+}
+
+func (p *pool) handle(handler nats.MsgHandler) nats.MsgHandler {
+	return func(m *nats.Msg) {
+		// count the message before waiting for a worker, so wait can't
+		// return while it is queued
+		p.wg.Add(1)
+		p.slots <- struct{}{}
+		go func() {
+			defer func() {
+				<-p.slots
+				p.wg.Done()
+			}()
+			handler(m)
+		}()
+	}
+}
+
+func (p *pool) busy() int {
+	return len(p.slots)
+}
+
+func (p *pool) size() int {
+	return cap(p.slots)
+}
+
+func (p *pool) wait() {
+	p.wg.Wait()
+}
+
+type status struct {
+	NATS         string `json:"nats"`
+	Subscribed   bool   `json:"subscribed"`
+	Workers      int    `json:"workers"`
+	BusyWorkers  int    `json:"busy_workers"`
+	Pending      int    `json:"pending"`
+	ShuttingDown bool   `json:"shutting_down"`
+}
+
+func natsState() string {
+	switch {
+	case nc == nil || nc.IsClosed():
+		return "closed"
+	case nc.IsReconnecting():
+		return "reconnecting"
+	case nc.IsConnected():
+		return "connected"
+	}
+	return "disconnected"
+}
+
+func currentStatus() status {
+	s := status{
+		NATS:         natsState(),
+		Subscribed:   len(subscriptions) > 0,
+		Workers:      workers.size(),
+		BusyWorkers:  workers.busy(),
+		ShuttingDown: atomic.LoadInt32(&shuttingDown) == 1,
+	}
+
+	for _, sub := range subscriptions {
+		if !sub.IsValid() {
+			s.Subscribed = false
+			continue
+		}
+		pending, _, _ := sub.Pending()
+		s.Pending += pending
+	}
+
+	return s
+}
+
+// Alive reports if the connector can still receive messages
+func (s status) Alive() bool {
+	return s.NATS != "closed"
+}
+
+// Ready reports if the connector can take on more messages, which it can't
+// while shutting down or when every worker is busy with messages queued
+func (s status) Ready() bool {
+	if s.ShuttingDown || s.NATS != "connected" || !s.Subscribed {
+		return false
+	}
+	return s.BusyWorkers < s.Workers || s.Pending == 0
+}
+
+func writeStatus(w http.ResponseWriter, s status, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(s)
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	s := currentStatus()
+	writeStatus(w, s, s.Alive())
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	s := currentStatus()
+	writeStatus(w, s, s.Ready())
+}
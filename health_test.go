@@ -0,0 +1,89 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nats-io/nats"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHealth(t *testing.T) {
+	testSetup()
+
+	Convey("Given a worker pool", t, func() {
+		p := newPool(1)
+		release := make(chan struct{})
+		done := make(chan struct{})
+		handler := p.handle(func(m *nats.Msg) {
+			<-release
+			close(done)
+		})
+
+		Convey("When every worker is busy", func() {
+			handler(&nats.Msg{})
+			Convey("It should report them as busy until they finish", func() {
+				So(p.busy(), ShouldEqual, 1)
+				close(release)
+				<-done
+				p.wait()
+				So(p.busy(), ShouldEqual, 0)
+			})
+		})
+	})
+
+	Convey("Given a running connector", t, func() {
+		workers = newPool(1)
+		sub, _ := nc.SubscribeSync("firewall.health.test")
+		subscriptions = []*nats.Subscription{sub}
+
+		Convey("When checking its health", func() {
+			w := httptest.NewRecorder()
+			healthzHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+			Convey("It should be alive", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+				So(w.Body.String(), ShouldContainSubstring, `"nats":"connected"`)
+			})
+		})
+
+		Convey("When checking its readiness", func() {
+			w := httptest.NewRecorder()
+			readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+			Convey("It should be ready", func() {
+				So(w.Code, ShouldEqual, http.StatusOK)
+			})
+		})
+
+		Convey("When checking its readiness while shutting down", func() {
+			atomic.StoreInt32(&shuttingDown, 1)
+			w := httptest.NewRecorder()
+			readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+			atomic.StoreInt32(&shuttingDown, 0)
+			Convey("It should not be ready", func() {
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(w.Body.String(), ShouldContainSubstring, `"shutting_down":true`)
+			})
+		})
+
+		Convey("When checking its readiness without a subscription", func() {
+			sub.Unsubscribe()
+			w := httptest.NewRecorder()
+			readyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+			Convey("It should not be ready", func() {
+				So(w.Code, ShouldEqual, http.StatusServiceUnavailable)
+				So(w.Body.String(), ShouldContainSubstring, `"subscribed":false`)
+			})
+		})
+
+		Reset(func() {
+			sub.Unsubscribe()
+			subscriptions = nil
+		})
+	})
+}
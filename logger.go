@@ -0,0 +1,49 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+var logger = logrus.New()
+
+// ErrLogFormatInvalid is returned for log formats other than json and text
+var ErrLogFormatInvalid = errors.New("Log format invalid")
+
+func configureLogger(level, format string) error {
+	if level != "" {
+		l, err := logrus.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+		logger.SetLevel(l)
+	}
+
+	switch format {
+	case "", "json":
+		logger.Formatter = &logrus.JSONFormatter{}
+	case "text":
+		logger.Formatter = &logrus.TextFormatter{}
+	default:
+		return ErrLogFormatInvalid
+	}
+
+	return nil
+}
+
+// log returns a logger carrying the fields needed to correlate the event
+// across services. Credentials must never be added here.
+func (ev *Event) log(operation string) *logrus.Entry {
+	return logger.WithFields(logrus.Fields{
+		"uuid":                  ev.UUID,
+		"batch_id":              ev.BatchID,
+		"security_group_aws_id": ev.SecurityGroupAWSID,
+		"region":                ev.DatacenterRegion,
+		"operation":             operation,
+	})
+}
@@ -0,0 +1,60 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLogger(t *testing.T) {
+	testSetup()
+
+	Convey("Given a logger", t, func() {
+		Convey("When configuring an unknown format", func() {
+			err := configureLogger("", "xml")
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrLogFormatInvalid)
+			})
+		})
+
+		Convey("When configuring an unknown level", func() {
+			err := configureLogger("loud", "json")
+			Convey("It should error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When logging an errored event", func() {
+			var out bytes.Buffer
+			configureLogger("info", "json")
+			logger.Out = &out
+
+			ev := testEvent
+			ev.DatacenterAccessKey = "AKIASECRETKEY"
+			ev.DatacenterAccessToken = "SECRETTOKEN"
+			ev.Error(errors.New("error"))
+			logger.Out = os.Stderr
+
+			Convey("It should attach the correlation fields", func() {
+				So(out.String(), ShouldContainSubstring, `"uuid":"test"`)
+				So(out.String(), ShouldContainSubstring, `"batch_id":"test"`)
+				So(out.String(), ShouldContainSubstring, `"security_group_aws_id":"sg-0000000"`)
+				So(out.String(), ShouldContainSubstring, `"region":"eu-west-1"`)
+				So(out.String(), ShouldContainSubstring, `"operation":"firewall.update.aws"`)
+				So(out.String(), ShouldContainSubstring, `"level":"error"`)
+			})
+
+			Convey("It should not log the credentials", func() {
+				So(out.String(), ShouldNotContainSubstring, "AKIASECRETKEY")
+				So(out.String(), ShouldNotContainSubstring, "SECRETTOKEN")
+			})
+		})
+	})
+}
@@ -5,37 +5,52 @@
 package main
 
 import (
-	"errors"
-	"fmt"
+	"context"
+	"encoding/json"
+	"net/http"
 	"os"
-	"runtime"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	ecc "github.com/ernestio/ernest-config-client"
 	"github.com/nats-io/nats"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 var nc *nats.Conn
 var natsErr error
 
+// rules per security group quotas, aws defaults to 60 in each direction
+var maxIngressRules = 60
+var maxEgressRules = 60
+
 func eventHandler(m *nats.Msg) {
 	var f Event
 
+	eventsReceived.Inc()
+
 	err := f.Process(m.Data)
 	if err != nil {
+		eventsErrored.WithLabelValues("DecodeError").Inc()
 		return
 	}
 
-	if err = f.Validate(); err != nil {
-		f.Error(err)
-		return
-	}
+	ctx, span := f.startSpan(f.context(), "firewall.update.aws")
+	defer span.End()
+	f.inject(ctx)
 
-	err = updateFirewall(&f)
+	err = processEvent(ctx, nil, &f)
 	if err != nil {
+		failSpan(span, err)
 		f.Error(err)
 		return
 	}
@@ -43,50 +58,252 @@ func eventHandler(m *nats.Msg) {
 	f.Complete()
 }
 
-func securityGroupByID(svc *ec2.EC2, id string) (*ec2.SecurityGroup, error) {
-	f := []*ec2.Filter{
-		&ec2.Filter{
-			Name:   aws.String("group-id"),
-			Values: []*string{aws.String(id)},
-		},
+// checkEvent validates the event and evaluates it against the policy,
+// then analyzes its rules
+func checkEvent(ctx context.Context, f *Event) error {
+	err := f.traced(ctx, "validate", func(context.Context) error {
+		return f.Validate()
+	})
+	if err != nil {
+		return err
 	}
 
-	req := ec2.DescribeSecurityGroupsInput{Filters: f}
-	resp, err := svc.DescribeSecurityGroups(&req)
+	err = f.traced(ctx, "policy", func(context.Context) error {
+		return policy.Evaluate(f)
+	})
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	f.traced(ctx, "analyze", func(context.Context) error {
+		f.analyze()
+		return nil
+	})
+
+	return nil
+}
+
+// processEvent validates and applies an event, counting its outcome. The
+// event's own client is used when no client is given.
+func processEvent(ctx context.Context, svc *ec2.EC2, f *Event) error {
+	err := checkEvent(ctx, f)
+	if _, ok := err.(*PolicyError); ok {
+		eventsErrored.WithLabelValues("PolicyViolation").Inc()
+		return err
+	}
+	if err != nil {
+		eventsErrored.WithLabelValues("ValidationError").Inc()
+		return err
 	}
 
-	if len(resp.SecurityGroups) != 1 {
-		return nil, errors.New("Could not find security group")
+	eventsValidated.Inc()
+
+	if svc == nil {
+		svc = ec2Client(f)
+	}
+
+	err = applyFirewall(ctx, svc, f)
+	if err != nil {
+		eventsErrored.WithLabelValues(errorCode(err)).Inc()
+		return err
+	}
+
+	eventsCompleted.Inc()
+	rc.store(*f)
+
+	return nil
+}
+
+func getEventHandler(m *nats.Msg) {
+	f := Event{subject: "firewall.get.aws"}
+
+	err := json.Unmarshal(m.Data, &f)
+	if err != nil {
+		f.Reply(m.Reply, err)
+		return
+	}
+
+	if err = f.ValidateGet(); err != nil {
+		f.Reply(m.Reply, err)
+		return
+	}
+
+	ctx, span := f.startSpan(f.context(), "firewall.get.aws")
+	defer span.End()
+	f.inject(ctx)
+
+	err = getFirewall(ctx, &f)
+	if err != nil {
+		failSpan(span, err)
+		f.Reply(m.Reply, err)
+		return
 	}
 
-	return resp.SecurityGroups[0], nil
+	f.Reply(m.Reply, nil)
+}
+
+// ec2Client returns a client for the event's region and credentials,
+// reused across events
+func ec2Client(ev *Event) *ec2.EC2 {
+	return clients.get(ev)
 }
 
-func updateFirewall(ev *Event) error {
+func newEC2Client(ev *Event) *ec2.EC2 {
 	creds := credentials.NewStaticCredentials(ev.DatacenterAccessKey, ev.DatacenterAccessToken, "")
 	svc := ec2.New(session.New(), &aws.Config{
 		Region:      aws.String(ev.DatacenterRegion),
 		Credentials: creds,
 	})
+	instrumentClient(svc)
+
+	return svc
+}
+
+func securityGroupFilters(ev *Event) []*ec2.Filter {
+	if ev.SecurityGroupAWSID != "" {
+		return []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("group-id"),
+				Values: []*string{aws.String(ev.SecurityGroupAWSID)},
+			},
+		}
+	}
+
+	return []*ec2.Filter{
+		&ec2.Filter{
+			Name:   aws.String("group-name"),
+			Values: []*string{aws.String(ev.SecurityGroupName)},
+		},
+		&ec2.Filter{
+			Name:   aws.String("vpc-id"),
+			Values: []*string{aws.String(ev.VPCID)},
+		},
+	}
+}
+
+// securityGroup describes the event's security group, looking it up by
+// name and vpc when no aws id is given and storing the resolved id
+func securityGroup(ctx context.Context, svc *ec2.EC2, ev *Event) (*ec2.SecurityGroup, error) {
+	var resp *ec2.DescribeSecurityGroupsOutput
+
+	req := ec2.DescribeSecurityGroupsInput{Filters: securityGroupFilters(ev)}
+	err := ev.traced(ctx, "DescribeSecurityGroups", func(ctx context.Context) (err error) {
+		resp, err = svc.DescribeSecurityGroupsWithContext(ctx, &req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(resp.SecurityGroups) {
+	case 0:
+		return nil, ErrSGNotFound
+	case 1:
+	default:
+		return nil, ErrSGAmbiguous
+	}
+
+	sg := resp.SecurityGroups[0]
+	ev.SecurityGroupAWSID = aws.StringValue(sg.GroupId)
+
+	return sg, nil
+}
+
+// verifySecurityGroup ensures the described group is the one the event
+// refers to before any change is made to it
+func verifySecurityGroup(ev *Event, sg *ec2.SecurityGroup) error {
+	if aws.StringValue(sg.VpcId) != ev.VPCID {
+		return ErrSGVPCMismatch
+	}
+
+	if aws.StringValue(sg.GroupName) != ev.SecurityGroupName {
+		return ErrSGNameMismatch
+	}
+
+	return nil
+}
+
+func getFirewall(ctx context.Context, ev *Event) error {
+	svc := ec2Client(ev)
+
+	sg, err := securityGroup(ctx, svc, ev)
+	if err != nil {
+		return err
+	}
+
+	describeEvent(ev, sg)
+
+	return nil
+}
+
+// describeEvent fills the event with the security group's definition
+func describeEvent(ev *Event, sg *ec2.SecurityGroup) {
+	ev.VPCID = aws.StringValue(sg.VpcId)
+	ev.SecurityGroupAWSID = aws.StringValue(sg.GroupId)
+	ev.SecurityGroupName = aws.StringValue(sg.GroupName)
+	ev.SecurityGroupRules.Ingress = buildRules(localPermissions(sg, sg.IpPermissions))
+	ev.SecurityGroupRules.Egress = buildRules(localPermissions(sg, sg.IpPermissionsEgress))
+	ev.Tags = buildTags(sg.Tags)
+}
+
+func updateFirewall(ctx context.Context, ev *Event) error {
+	return applyFirewall(ctx, ec2Client(ev), ev)
+}
+
+// applyFirewall updates the event's security group using the given client,
+// describing the group again when its cached state turns out to be stale
+func applyFirewall(ctx context.Context, svc *ec2.EC2, ev *Event) error {
+	err := updateSecurityGroup(ctx, svc, ev, false)
+	if isConflict(err) {
+		ev.log("firewall.update.aws").WithError(err).Warn("security group changed, describing it again")
+		err = updateSecurityGroup(ctx, svc, ev, true)
+	}
+	if err != nil {
+		describedGroups.invalidate(ev)
+	}
+	return err
+}
 
-	sg, err := securityGroupByID(svc, ev.SecurityGroupAWSID)
+func updateSecurityGroup(ctx context.Context, svc *ec2.EC2, ev *Event, refresh bool) error {
+	sg, err := cachedSecurityGroup(ctx, svc, ev, refresh)
 	if err != nil {
 		return err
 	}
 
+	if err = verifySecurityGroup(ev, sg); err != nil {
+		return err
+	}
+
+	if err = verifyOwnership(sg); err != nil {
+		return err
+	}
+
+	_, span := ev.startSpan(ctx, "diff")
+
 	// generate the new rulesets
-	newIngressRules := buildPermissions(ev.SecurityGroupRules.Ingress)
-	newEgressRules := buildPermissions(ev.SecurityGroupRules.Egress)
+	ingressRules, egressRules := ev.desiredRules()
+	newIngressRules := buildPermissions(ingressRules)
+	newEgressRules := buildPermissions(egressRules)
+
+	// only managed rules can be revoked
+	liveIngress, unmanagedIngress := ev.managedPermissions(localPermissions(sg, sg.IpPermissions))
+	liveEgress, unmanagedEgress := ev.managedPermissions(localPermissions(sg, sg.IpPermissionsEgress))
+	defaultEgress := defaultEgressResult(sg.IpPermissionsEgress, append(append([]*ec2.IpPermission{}, newEgressRules...), unmanagedEgress...))
 
-	// generate the rules to remove
-	revokeIngressRules := buildRevokePermissions(sg.IpPermissions, newIngressRules)
-	revokeEgressRules := buildRevokePermissions(sg.IpPermissionsEgress, newEgressRules)
+	// generate the rules to remove and the missing rules to add
+	revokeIngressRules, newIngressRules := diffPermissions(newIngressRules, liveIngress, unmanagedIngress)
+	revokeEgressRules, newEgressRules := diffPermissions(newEgressRules, liveEgress, unmanagedEgress)
+
+	span.End()
+
+	// check quotas before any change, so an oversized event leaves the group untouched
+	err = checkQuotas(ev, sg, revokeIngressRules, newIngressRules, revokeEgressRules, newEgressRules)
+	if err != nil {
+		return err
+	}
 
-	// remove already existing rules from the new ruleset
-	newIngressRules = deduplicateRules(newIngressRules, sg.IpPermissions)
-	newEgressRules = deduplicateRules(newEgressRules, sg.IpPermissionsEgress)
+	ingress := auditState{Before: buildRules(sg.IpPermissions), After: append(ingressRules, buildRules(unmanagedIngress)...)}
+	egress := auditState{Before: buildRules(sg.IpPermissionsEgress), After: append(egressRules, buildRules(unmanagedEgress)...)}
 
 	// Revoke Ingress
 	if len(revokeIngressRules) > 0 {
@@ -95,7 +312,8 @@ func updateFirewall(ev *Event) error {
 			IpPermissions: revokeIngressRules,
 		}
 
-		_, err := svc.RevokeSecurityGroupIngress(&iReq)
+		req, _ := svc.RevokeSecurityGroupIngressRequest(&iReq)
+		err := applyChange(ctx, ev, req, "revoke", "ingress", revokeIngressRules, ingress)
 		if err != nil {
 			return err
 		}
@@ -107,7 +325,9 @@ func updateFirewall(ev *Event) error {
 			GroupId:       aws.String(ev.SecurityGroupAWSID),
 			IpPermissions: revokeEgressRules,
 		}
-		_, err := svc.RevokeSecurityGroupEgress(&eReq)
+
+		req, _ := svc.RevokeSecurityGroupEgressRequest(&eReq)
+		err := applyChange(ctx, ev, req, "revoke", "egress", revokeEgressRules, egress)
 		if err != nil {
 			return err
 		}
@@ -120,7 +340,8 @@ func updateFirewall(ev *Event) error {
 			IpPermissions: newIngressRules,
 		}
 
-		_, err := svc.AuthorizeSecurityGroupIngress(&iReq)
+		req, _ := svc.AuthorizeSecurityGroupIngressRequest(&iReq)
+		err := applyChange(ctx, ev, req, "authorize", "ingress", newIngressRules, ingress)
 		if err != nil {
 			return err
 		}
@@ -133,20 +354,218 @@ func updateFirewall(ev *Event) error {
 			IpPermissions: newEgressRules,
 		}
 
-		_, err := svc.AuthorizeSecurityGroupEgress(&eReq)
+		req, _ := svc.AuthorizeSecurityGroupEgressRequest(&eReq)
+		err := applyChange(ctx, ev, req, "authorize", "egress", newEgressRules, egress)
 		if err != nil {
 			return err
 		}
 	}
 
+	if err = updateTags(ctx, svc, ev, sg); err != nil {
+		return err
+	}
+
+	describedGroups.update(ev, appliedGroup(sg, revokeIngressRules, newIngressRules, revokeEgressRules, newEgressRules, changedTags(sg, ev.Tags)))
+
+	if ev.EgressDefault == "" {
+		ev.EgressDefault = egressDefaultStrict
+	}
+	ev.DefaultEgressRule = defaultEgress
+
+	if ev.PartialManagement {
+		ev.UnmanagedRules = &ruleSet{Ingress: buildRules(unmanagedIngress), Egress: buildRules(unmanagedEgress)}
+	}
+
+	return nil
+}
+
+// quotas returns the rules quotas of the event's account, which events
+// can raise or lower when the account's limits differ from the defaults
+func (ev *Event) quotas() (ingress, egress int) {
+	ingress, egress = maxIngressRules, maxEgressRules
+	if ev.MaxIngressRules > 0 {
+		ingress = ev.MaxIngressRules
+	}
+	if ev.MaxEgressRules > 0 {
+		egress = ev.MaxEgressRules
+	}
+	return ingress, egress
+}
+
+func checkQuotas(ev *Event, sg *ec2.SecurityGroup, revokeIngress, authorizeIngress, revokeEgress, authorizeEgress []*ec2.IpPermission) error {
+	maxIngress, maxEgress := ev.quotas()
+
+	if projectedRules(sg.IpPermissions, revokeIngress, authorizeIngress) > maxIngress {
+		return ErrSGIngressQuotaExceeded
+	}
+
+	if projectedRules(sg.IpPermissionsEgress, revokeEgress, authorizeEgress) > maxEgress {
+		return ErrSGEgressQuotaExceeded
+	}
+
 	return nil
 }
 
+// applyChange sends a revoke or authorize request for one direction of the
+// security group, recording it once aws has accepted it
+func applyChange(ctx context.Context, ev *Event, req *request.Request, action, direction string, perms []*ec2.IpPermission, state auditState) error {
+	operation := req.Operation.Name
+
+	err := ev.traced(ctx, operation, func(ctx context.Context) error {
+		req.SetContext(ctx)
+		return req.Send()
+	})
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "revoke":
+		rulesRevoked.WithLabelValues(direction).Add(float64(countRules(perms)))
+	case "authorize":
+		rulesAuthorized.WithLabelValues(direction).Add(float64(countRules(perms)))
+	}
+
+	ev.log(operation).WithFields(logrus.Fields{
+		"direction":      direction,
+		"rules":          countRules(perms),
+		"aws_request_id": req.RequestID,
+	}).Info("applied rules")
+
+	if audit == nil {
+		return nil
+	}
+
+	entry := newAuditEntry(ev, action, direction, perms, state)
+	entry.RequestID = req.RequestID
+
+	return audit.Write(&entry)
+}
+
+func durationFromEnv(key string) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logger.Panic(err)
+	}
+	return d
+}
+
+func intFromEnv(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		logger.Panic(err)
+	}
+	return i
+}
+
+func subscribe(subject string, handler nats.MsgHandler) {
+	logger.Info("listening for " + subject)
+
+	sub, err := nc.Subscribe(subject, workers.handle(handler))
+	if err != nil {
+		logger.Panic(err)
+	}
+	subscriptions = append(subscriptions, sub)
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
+	err := configureLogger(os.Getenv("LOG_LEVEL"), os.Getenv("LOG_FORMAT"))
+	if err != nil {
+		logger.Panic(err)
+	}
+
+	shutdownTracing, err := configureTracing(os.Getenv("TRACE_EXPORTER"), os.Getenv("TRACE_FILE"))
+	if err != nil {
+		logger.Panic(err)
+	}
+
 	nc = ecc.NewConfig(os.Getenv("NATS_URI")).Nats()
 
-	fmt.Println("listening for firewall.update.aws")
-	nc.Subscribe("firewall.update.aws", eventHandler)
+	policy, err = loadPolicy(os.Getenv("POLICY_FILE"))
+	if err != nil {
+		logger.Panic(err)
+	}
+
+	if err = loadServices(os.Getenv("SERVICES_FILE")); err != nil {
+		logger.Panic(err)
+	}
+
+	if err = configureCIDRGroups(os.Getenv("CIDR_GROUPS_FILE")); err != nil {
+		logger.Panic(err)
+	}
+
+	maxIngressRules = intFromEnv("MAX_INGRESS_RULES", maxIngressRules)
+	maxEgressRules = intFromEnv("MAX_EGRESS_RULES", maxEgressRules)
+	configureTags(os.Getenv("OWNERSHIP_TAG"), os.Getenv("PROTECTED_TAG"))
+	configureManagedRules(os.Getenv("MANAGED_RULE_PREFIX"))
+	batchConcurrency = intFromEnv("BATCH_CONCURRENCY", batchConcurrency)
+
+	ttl := clients.ttl
+	if os.Getenv("CLIENT_CACHE_TTL") != "" {
+		ttl = durationFromEnv("CLIENT_CACHE_TTL")
+	}
+	clients = newClientCache(ttl, intFromEnv("CLIENT_CACHE_SIZE", clients.size))
+
+	describedGroups = newGroupCache(durationFromEnv("DESCRIBE_CACHE_TTL"))
 
-	runtime.Goexit()
+	audit, err = configureAudit(os.Getenv("AUDIT_FILE"), os.Getenv("AUDIT_SUBJECT"))
+	if err != nil {
+		logger.Panic(err)
+	}
+
+	addr := os.Getenv("HTTP_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+
+	workers = newPool(intFromEnv("WORKERS", 1))
+
+	rc = newReconciler(durationFromEnv("RECONCILE_INTERVAL"), durationFromEnv("RECONCILE_JITTER"))
+	if rc.interval > 0 {
+		logger.Info("reconciling security groups every " + rc.interval.String())
+		go rc.run()
+	}
+
+	subscribe("firewall.update.aws", eventHandler)
+	subscribe("firewall.batch.aws", batchEventHandler)
+	subscribe("firewall.get.aws", getEventHandler)
+	subscribe("firewall.check.aws", checkEventHandler)
+	subscribe("nacl.update.aws", naclEventHandler)
+	subscribe("cidr_group.update.aws", cidrGroupEventHandler)
+
+	// serve the health checks once every subject is subscribed, as they read
+	// the subscriptions
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+	go func() {
+		logger.Panic(http.ListenAndServe(addr, nil))
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+
+	// stop reporting ready and let in flight events finish before exiting
+	atomic.StoreInt32(&shuttingDown, 1)
+	for _, sub := range subscriptions {
+		sub.Unsubscribe()
+	}
+	workers.wait()
+	nc.Close()
+	shutdownTracing(context.Background())
 }
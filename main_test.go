@@ -0,0 +1,185 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSecurityGroupFilters(t *testing.T) {
+	Convey("Given an event", t, func() {
+		Convey("With a security group aws id", func() {
+			ev := testEvent
+			filters := securityGroupFilters(&ev)
+			Convey("It should look the group up by id", func() {
+				So(len(filters), ShouldEqual, 1)
+				So(*filters[0].Name, ShouldEqual, "group-id")
+				So(*filters[0].Values[0], ShouldEqual, "sg-0000000")
+			})
+		})
+
+		Convey("With no security group aws id", func() {
+			ev := testEvent
+			ev.SecurityGroupAWSID = ""
+			filters := securityGroupFilters(&ev)
+			Convey("It should look the group up by name and vpc", func() {
+				So(len(filters), ShouldEqual, 2)
+				So(*filters[0].Name, ShouldEqual, "group-name")
+				So(*filters[0].Values[0], ShouldEqual, "test")
+				So(*filters[1].Name, ShouldEqual, "vpc-id")
+				So(*filters[1].Values[0], ShouldEqual, "vpc-0000000")
+			})
+		})
+	})
+}
+
+func TestVerifySecurityGroup(t *testing.T) {
+	Convey("Given an event and a described security group", t, func() {
+		ev := testEvent
+		sg := ec2.SecurityGroup{
+			GroupId:   aws.String("sg-0000000"),
+			GroupName: aws.String("test"),
+			VpcId:     aws.String("vpc-0000000"),
+		}
+
+		Convey("When the group matches the event", func() {
+			err := verifySecurityGroup(&ev, &sg)
+			Convey("It should not error", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When the group belongs to another vpc", func() {
+			sg.VpcId = aws.String("vpc-1111111")
+			err := verifySecurityGroup(&ev, &sg)
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrSGVPCMismatch)
+			})
+		})
+
+		Convey("When the group has another name", func() {
+			sg.GroupName = aws.String("other")
+			err := verifySecurityGroup(&ev, &sg)
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrSGNameMismatch)
+			})
+		})
+	})
+}
+
+func TestCheckQuotas(t *testing.T) {
+	Convey("Given a security group holding merged rules", t, func() {
+		sg := ec2.SecurityGroup{
+			IpPermissions:       testMergedRuleset,
+			IpPermissionsEgress: testMergedRuleset,
+		}
+
+		Convey("When the update stays within the quotas", func() {
+			maxIngressRules = 3
+			maxEgressRules = 3
+			err := checkQuotas(&testEvent, &sg, testMergedRuleset[:1], testNewRuleset, nil, nil)
+			Convey("It should not error", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When the update exceeds the inbound quota", func() {
+			maxIngressRules = 3
+			err := checkQuotas(&testEvent, &sg, nil, testNewRuleset, nil, nil)
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrSGIngressQuotaExceeded)
+			})
+		})
+
+		Convey("When the update exceeds the outbound quota", func() {
+			maxEgressRules = 4
+			err := checkQuotas(&testEvent, &sg, nil, nil, testMergedRuleset[1:], testNewRulesetAddition)
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrSGEgressQuotaExceeded)
+			})
+		})
+
+		Convey("When the event sets its own inbound quota", func() {
+			ev := testEvent
+			ev.MaxIngressRules = 10
+			maxIngressRules = 3
+			err := checkQuotas(&ev, &sg, nil, testNewRuleset, nil, nil)
+			Convey("It should count the rules against the event's quota", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Reset(func() {
+			maxIngressRules = 60
+			maxEgressRules = 60
+		})
+	})
+}
+
+func TestDescribeEvent(t *testing.T) {
+	Convey("Given a security group with icmp and cross account rules", t, func() {
+		live := []*ec2.IpPermission{
+			&ec2.IpPermission{
+				FromPort:   aws.Int64(-1),
+				ToPort:     aws.Int64(-1),
+				IpProtocol: aws.String("icmp"),
+				IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("10.0.0.0/16")}},
+			},
+			&ec2.IpPermission{
+				FromPort:   aws.Int64(8),
+				ToPort:     aws.Int64(-1),
+				IpProtocol: aws.String("icmp"),
+				IpRanges:   []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String("10.1.0.0/16")}},
+			},
+			&ec2.IpPermission{
+				FromPort:   aws.Int64(5432),
+				ToPort:     aws.Int64(5432),
+				IpProtocol: aws.String("tcp"),
+				UserIdGroupPairs: []*ec2.UserIdGroupPair{
+					&ec2.UserIdGroupPair{GroupId: aws.String("sg-2222222"), UserId: aws.String("222222222222")},
+				},
+			},
+		}
+		sg := ec2.SecurityGroup{
+			GroupId:             aws.String("sg-0000000"),
+			GroupName:           aws.String("test"),
+			VpcId:               aws.String("vpc-0000000"),
+			OwnerId:             aws.String("111111111111"),
+			IpPermissions:       live,
+			IpPermissionsEgress: live[:1],
+		}
+
+		Convey("When describing it as an event", func() {
+			ev := testEvent
+			describeEvent(&ev, &sg)
+
+			Convey("It should be a valid event", func() {
+				So(ev.Validate(), ShouldBeNil)
+				So(ev.SecurityGroupRules.Ingress[2].SourceGroupOwner, ShouldEqual, "222222222222")
+			})
+
+			Convey("It should map back to the live permissions", func() {
+				So(buildPermissions(ev.SecurityGroupRules.Ingress), ShouldResemble, live)
+				So(buildPermissions(ev.SecurityGroupRules.Egress), ShouldResemble, live[:1])
+			})
+		})
+
+		Convey("When a source group belongs to the group's own account", func() {
+			sg.IpPermissions[2].UserIdGroupPairs[0].UserId = aws.String("111111111111")
+			ev := testEvent
+			describeEvent(&ev, &sg)
+
+			Convey("It should leave the owner out", func() {
+				So(ev.SecurityGroupRules.Ingress[2].SourceGroupOwner, ShouldEqual, "")
+				d := buildDrift(&ev, &sg)
+				So(d.Detected(), ShouldBeFalse)
+			})
+		})
+	})
+}
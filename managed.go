@@ -0,0 +1,88 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// managedRulePrefix starts the description of every rule the connector
+// authorizes for events partially managing their group, so only those
+// rules are ever revoked
+var managedRulePrefix = "[ernest]"
+
+type ruleSet struct {
+	Ingress []rule `json:"ingress"`
+	Egress  []rule `json:"egress"`
+}
+
+func configureManagedRules(prefix string) {
+	if prefix != "" {
+		managedRulePrefix = prefix
+	}
+}
+
+func isManaged(description string) bool {
+	return strings.HasPrefix(description, managedRulePrefix)
+}
+
+// markRules prefixes the rules descriptions with the managed rule marker
+func markRules(rules []rule) []rule {
+	marked := make([]rule, len(rules))
+
+	for i, r := range rules {
+		switch {
+		case isManaged(r.Description):
+		case r.Description == "":
+			r.Description = managedRulePrefix
+		default:
+			r.Description = managedRulePrefix + " " + r.Description
+		}
+		marked[i] = r
+	}
+
+	return marked
+}
+
+// desiredRules returns the atomic rules the group should hold, collapsed
+// when the event asks for it and marked as managed when the event
+// partially manages the group. The event's own rules are left untouched.
+func (ev *Event) desiredRules() (ingress, egress []rule) {
+	ingress = expandRules(ev.SecurityGroupRules.Ingress)
+	egress = expandRules(ev.egressRules())
+
+	if ev.CollapseRules {
+		ingress = collapseRules(ingress)
+		egress = collapseRules(egress)
+	}
+
+	if ev.PartialManagement {
+		ingress = markRules(ingress)
+		egress = markRules(egress)
+	}
+
+	return ingress, egress
+}
+
+// managedPermissions splits the normalized live permissions into the ones
+// the connector may revoke and the ones it must leave alone. Events
+// managing the whole group may revoke any of them.
+func (ev *Event) managedPermissions(perms []*ec2.IpPermission) (managed, unmanaged []*ec2.IpPermission) {
+	if !ev.PartialManagement {
+		return normalizePermissions(perms), nil
+	}
+
+	for _, p := range normalizePermissions(perms) {
+		if isManaged(buildRules([]*ec2.IpPermission{p})[0].Description) {
+			managed = append(managed, p)
+		} else {
+			unmanaged = append(unmanaged, p)
+		}
+	}
+
+	return managed, unmanaged
+}
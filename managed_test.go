@@ -0,0 +1,83 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestManagedRules(t *testing.T) {
+	Convey("Given an event partially managing its group", t, func() {
+		ev := testEvent
+		buildTestRules(&ev)
+		ev.PartialManagement = true
+		ev.SecurityGroupRules.Ingress[0].Description = "web"
+
+		live := []*ec2.IpPermission{
+			&ec2.IpPermission{
+				IpRanges: []*ec2.IpRange{
+					&ec2.IpRange{CidrIp: aws.String("10.0.10.100/32"), Description: aws.String("[ernest] web")},
+					&ec2.IpRange{CidrIp: aws.String("10.0.10.101/32"), Description: aws.String("[ernest]")},
+					&ec2.IpRange{CidrIp: aws.String("10.0.10.102/32"), Description: aws.String("temporary access")},
+				},
+				FromPort:   aws.Int64(80),
+				ToPort:     aws.Int64(8080),
+				IpProtocol: aws.String("tcp"),
+			},
+		}
+
+		Convey("When building the desired rules", func() {
+			ingress, egress := ev.desiredRules()
+			Convey("It should mark them as managed", func() {
+				So(ingress[0].Description, ShouldEqual, "[ernest] web")
+				So(egress[0].Description, ShouldEqual, "[ernest]")
+			})
+		})
+
+		Convey("When splitting the live rules", func() {
+			managed, unmanaged := ev.managedPermissions(live)
+			Convey("It should only consider marked rules as managed", func() {
+				So(len(managed), ShouldEqual, 2)
+				So(len(unmanaged), ShouldEqual, 1)
+				So(*unmanaged[0].IpRanges[0].CidrIp, ShouldEqual, "10.0.10.102/32")
+			})
+		})
+
+		Convey("When building the drift", func() {
+			sg := ec2.SecurityGroup{IpPermissions: live}
+			d := buildDrift(&ev, &sg)
+			Convey("It should ignore unmanaged rules", func() {
+				So(len(d.Ingress.Extra), ShouldEqual, 1)
+				So(d.Ingress.Extra[0].IP, ShouldEqual, "10.0.10.101/32")
+				So(len(d.Ingress.Missing), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When the live group holds an unmarked copy of a desired rule", func() {
+			live[0].IpRanges[0].Description = aws.String("web")
+			ingress, _ := ev.desiredRules()
+			managed, unmanaged := ev.managedPermissions(live)
+			revoke, authorize := diffPermissions(buildPermissions(ingress), managed, unmanaged)
+			Convey("It should neither authorize it again nor revoke it", func() {
+				So(len(authorize), ShouldEqual, 0)
+				So(len(revoke), ShouldEqual, 1)
+				So(*revoke[0].IpRanges[0].CidrIp, ShouldEqual, "10.0.10.101/32")
+			})
+		})
+
+		Convey("When the event manages the whole group", func() {
+			ev.PartialManagement = false
+			managed, unmanaged := ev.managedPermissions(live)
+			Convey("It should consider every rule as managed", func() {
+				So(managed, ShouldResemble, normalizePermissions(live))
+				So(unmanaged, ShouldBeNil)
+			})
+		})
+	})
+}
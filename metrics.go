@@ -0,0 +1,85 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	eventsReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "firewall_updater_events_received_total",
+		Help: "Number of firewall.update.aws events received, counting each group of a batch.",
+	})
+	eventsValidated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "firewall_updater_events_validated_total",
+		Help: "Number of events that passed validation.",
+	})
+	eventsCompleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "firewall_updater_events_completed_total",
+		Help: "Number of events applied successfully.",
+	})
+	eventsErrored = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "firewall_updater_events_errored_total",
+		Help: "Number of events that failed, by error code.",
+	}, []string{"code"})
+	rulesAuthorized = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "firewall_updater_rules_authorized_total",
+		Help: "Number of rules authorized, by direction.",
+	}, []string{"direction"})
+	rulesRevoked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "firewall_updater_rules_revoked_total",
+		Help: "Number of rules revoked, by direction.",
+	}, []string{"direction"})
+	awsCallDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "firewall_updater_aws_call_duration_seconds",
+		Help: "Latency of AWS API calls, including retries, by operation.",
+	}, []string{"operation"})
+	awsCallRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "firewall_updater_aws_call_retries_total",
+		Help: "Number of AWS API call retries, by operation.",
+	}, []string{"operation"})
+	describeCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "firewall_updater_describe_cache_lookups_total",
+		Help: "Number of security group state lookups, by hit or miss.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		eventsReceived,
+		eventsValidated,
+		eventsCompleted,
+		eventsErrored,
+		rulesAuthorized,
+		rulesRevoked,
+		awsCallDuration,
+		awsCallRetries,
+		describeCacheLookups,
+	)
+}
+
+// instrumentClient records the latency and retries of every call made
+// through the client
+func instrumentClient(svc *ec2.EC2) {
+	svc.Handlers.Complete.PushBack(func(r *request.Request) {
+		awsCallDuration.WithLabelValues(r.Operation.Name).Observe(time.Since(r.Time).Seconds())
+		if r.RetryCount > 0 {
+			awsCallRetries.WithLabelValues(r.Operation.Name).Add(float64(r.RetryCount))
+		}
+	})
+}
+
+func errorCode(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code()
+	}
+	return "InternalError"
+}
@@ -0,0 +1,31 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestMetrics(t *testing.T) {
+	Convey("Given an error", t, func() {
+		Convey("When it is an aws error", func() {
+			err := awserr.New("InvalidGroup.NotFound", "not found", nil)
+			Convey("It should be labeled with the aws error code", func() {
+				So(errorCode(err), ShouldEqual, "InvalidGroup.NotFound")
+			})
+		})
+
+		Convey("When it is a connector error", func() {
+			err := errors.New("error")
+			Convey("It should be labeled as an internal error", func() {
+				So(errorCode(err), ShouldEqual, "InternalError")
+			})
+		})
+	})
+}
@@ -0,0 +1,382 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/nats-io/nats"
+)
+
+// the entry closing every network acl, which can't be changed
+const defaultACLRuleNumber = 32767
+
+var (
+	ErrNetworkAWSIDInvalid    = errors.New("Network aws id invalid")
+	ErrACLRulesInvalid        = errors.New("Network ACL must contain rules")
+	ErrACLRuleNumberInvalid   = errors.New("Network ACL rule number invalid")
+	ErrACLRuleNumberDuplicate = errors.New("Network ACL rule number duplicated")
+	ErrACLRuleActionInvalid   = errors.New("Network ACL rule action invalid")
+	ErrACLRuleIPInvalid       = errors.New("Network ACL rule ip invalid")
+	ErrACLRuleProtocolInvalid = errors.New("Network ACL rule protocol invalid")
+	ErrACLRuleFromPortInvalid = errors.New("Network ACL rule from port invalid")
+	ErrACLRuleToPortInvalid   = errors.New("Network ACL rule to port invalid")
+	ErrACLNotFound            = errors.New("Could not find network acl")
+	ErrACLVPCMismatch         = errors.New("Network ACL does not belong to the datacenter VPC")
+)
+
+type aclRule struct {
+	RuleNumber int64  `json:"rule_number"`
+	Action     string `json:"action"`
+	Protocol   string `json:"protocol"`
+	IP         string `json:"ip"`
+	FromPort   int64  `json:"from_port"`
+	ToPort     int64  `json:"to_port"`
+}
+
+type aclRules struct {
+	Ingress []aclRule `json:"ingress"`
+	Egress  []aclRule `json:"egress"`
+}
+
+// ValidateNetworkACL checks if all criteria to update a network acl are met
+func (ev *Event) ValidateNetworkACL() error {
+	if ev.VPCID == "" {
+		return ErrDatacenterIDInvalid
+	}
+
+	if ev.DatacenterRegion == "" {
+		return ErrDatacenterRegionInvalid
+	}
+
+	if ev.DatacenterAccessKey == "" || ev.DatacenterAccessToken == "" {
+		return ErrDatacenterCredentialsInvalid
+	}
+
+	if ev.NetworkAWSID == "" {
+		return ErrNetworkAWSIDInvalid
+	}
+
+	if ev.NetworkACLRules == nil || len(ev.NetworkACLRules.Ingress) < 1 && len(ev.NetworkACLRules.Egress) < 1 {
+		return ErrACLRulesInvalid
+	}
+
+	if err := validateACLRules(ev.NetworkACLRules.Ingress); err != nil {
+		return err
+	}
+
+	return validateACLRules(ev.NetworkACLRules.Egress)
+}
+
+func validateACLRules(rules []aclRule) error {
+	numbers := make(map[int64]bool)
+
+	for _, rule := range rules {
+		if rule.RuleNumber < 1 || rule.RuleNumber >= defaultACLRuleNumber {
+			return ErrACLRuleNumberInvalid
+		}
+		if numbers[rule.RuleNumber] {
+			return ErrACLRuleNumberDuplicate
+		}
+		numbers[rule.RuleNumber] = true
+
+		if rule.Action != ec2.RuleActionAllow && rule.Action != ec2.RuleActionDeny {
+			return ErrACLRuleActionInvalid
+		}
+		if _, err := parseNetwork(rule.IP); err != nil {
+			return ErrACLRuleIPInvalid
+		}
+		if err := validateACLPorts(rule); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateACLPorts checks the ports of a rule as aws does for its
+// protocol. -1 stands for any icmp type or code, and ports are ignored on
+// rules for all protocols.
+func validateACLPorts(rule aclRule) error {
+	min, max := int64(0), int64(65535)
+
+	switch aclProtocol(rule.Protocol) {
+	case "":
+		return ErrACLRuleProtocolInvalid
+	case "1":
+		min, max = -1, 255
+	case "-1":
+		return nil
+	}
+
+	if rule.FromPort < min || rule.FromPort > max {
+		return ErrACLRuleFromPortInvalid
+	}
+	if rule.ToPort < min || rule.ToPort > max {
+		return ErrACLRuleToPortInvalid
+	}
+	if aclProtocol(rule.Protocol) != "1" && rule.FromPort > rule.ToPort {
+		return ErrACLRuleToPortInvalid
+	}
+
+	return nil
+}
+
+// aclProtocol maps a protocol to the number network acls expect, returning
+// an empty string for unsupported protocols
+func aclProtocol(protocol string) string {
+	switch protocolName(protocol) {
+	case "tcp":
+		return "6"
+	case "udp":
+		return "17"
+	case "icmp":
+		return "1"
+	case "all":
+		return "-1"
+	}
+	return ""
+}
+
+func naclEventHandler(m *nats.Msg) {
+	f := Event{subject: "nacl.update.aws"}
+
+	err := f.Process(m.Data)
+	if err != nil {
+		return
+	}
+
+	ctx, span := f.startSpan(f.context(), "nacl.update.aws")
+	defer span.End()
+	f.inject(ctx)
+
+	if err = f.ValidateNetworkACL(); err != nil {
+		failSpan(span, err)
+		f.Error(err)
+		return
+	}
+
+	err = updateNetworkACL(ctx, &f)
+	if err != nil {
+		failSpan(span, err)
+		f.Error(err)
+		return
+	}
+
+	f.Complete()
+}
+
+func networkACL(ctx context.Context, svc *ec2.EC2, ev *Event) (*ec2.NetworkAcl, error) {
+	var resp *ec2.DescribeNetworkAclsOutput
+
+	req := ec2.DescribeNetworkAclsInput{
+		Filters: []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("association.subnet-id"),
+				Values: []*string{aws.String(ev.NetworkAWSID)},
+			},
+		},
+	}
+
+	err := ev.traced(ctx, "DescribeNetworkAcls", func(ctx context.Context) (err error) {
+		resp, err = svc.DescribeNetworkAclsWithContext(ctx, &req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.NetworkAcls) != 1 {
+		return nil, ErrACLNotFound
+	}
+
+	acl := resp.NetworkAcls[0]
+	if aws.StringValue(acl.VpcId) != ev.VPCID {
+		return nil, ErrACLVPCMismatch
+	}
+
+	return acl, nil
+}
+
+func updateNetworkACL(ctx context.Context, ev *Event) error {
+	svc := ec2Client(ev)
+
+	acl, err := networkACL(ctx, svc, ev)
+	if err != nil {
+		return err
+	}
+
+	id := aws.StringValue(acl.NetworkAclId)
+
+	for _, egress := range []bool{false, true} {
+		desired := ev.NetworkACLRules.Ingress
+		if egress {
+			desired = ev.NetworkACLRules.Egress
+		}
+
+		remove, replace, create := diffACLRules(buildACLRules(acl.Entries, egress), desired)
+
+		for _, r := range remove {
+			req := ec2.DeleteNetworkAclEntryInput{
+				NetworkAclId: aws.String(id),
+				RuleNumber:   aws.Int64(r.RuleNumber),
+				Egress:       aws.Bool(egress),
+			}
+			err := ev.traced(ctx, "DeleteNetworkAclEntry", func(ctx context.Context) error {
+				_, err := svc.DeleteNetworkAclEntryWithContext(ctx, &req)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, r := range replace {
+			e := buildACLEntry(r, egress)
+			req := ec2.ReplaceNetworkAclEntryInput{
+				NetworkAclId: aws.String(id),
+				RuleNumber:   e.RuleNumber,
+				Egress:       e.Egress,
+				Protocol:     e.Protocol,
+				RuleAction:   e.RuleAction,
+				CidrBlock:    e.CidrBlock,
+				PortRange:    e.PortRange,
+				IcmpTypeCode: e.IcmpTypeCode,
+			}
+			err := ev.traced(ctx, "ReplaceNetworkAclEntry", func(ctx context.Context) error {
+				_, err := svc.ReplaceNetworkAclEntryWithContext(ctx, &req)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, r := range create {
+			e := buildACLEntry(r, egress)
+			req := ec2.CreateNetworkAclEntryInput{
+				NetworkAclId: aws.String(id),
+				RuleNumber:   e.RuleNumber,
+				Egress:       e.Egress,
+				Protocol:     e.Protocol,
+				RuleAction:   e.RuleAction,
+				CidrBlock:    e.CidrBlock,
+				PortRange:    e.PortRange,
+				IcmpTypeCode: e.IcmpTypeCode,
+			}
+			err := ev.traced(ctx, "CreateNetworkAclEntry", func(ctx context.Context) error {
+				_, err := svc.CreateNetworkAclEntryWithContext(ctx, &req)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		ev.log("nacl.update.aws").WithField("egress", egress).
+			Infof("deleted %d, replaced %d and created %d network acl entries", len(remove), len(replace), len(create))
+	}
+
+	return nil
+}
+
+// normalizeACLRule maps a rule to the form aws describes it in
+func normalizeACLRule(r aclRule) aclRule {
+	r.Action = strings.ToLower(r.Action)
+	r.Protocol = aclProtocol(r.Protocol)
+	if r.Protocol == "-1" {
+		r.FromPort = 0
+		r.ToPort = 0
+	}
+	return r
+}
+
+func buildACLEntry(r aclRule, egress bool) *ec2.NetworkAclEntry {
+	r = normalizeACLRule(r)
+
+	e := ec2.NetworkAclEntry{
+		RuleNumber: aws.Int64(r.RuleNumber),
+		Egress:     aws.Bool(egress),
+		Protocol:   aws.String(r.Protocol),
+		RuleAction: aws.String(r.Action),
+		CidrBlock:  aws.String(r.IP),
+	}
+
+	switch r.Protocol {
+	case "6", "17":
+		e.PortRange = &ec2.PortRange{From: aws.Int64(r.FromPort), To: aws.Int64(r.ToPort)}
+	case "1":
+		e.IcmpTypeCode = &ec2.IcmpTypeCode{Type: aws.Int64(r.FromPort), Code: aws.Int64(r.ToPort)}
+	}
+
+	return &e
+}
+
+// buildACLRules maps the entries of one direction back to rules, leaving
+// out the default entry and ipv6 entries
+func buildACLRules(entries []*ec2.NetworkAclEntry, egress bool) []aclRule {
+	var rules []aclRule
+
+	for _, e := range entries {
+		if aws.BoolValue(e.Egress) != egress || e.CidrBlock == nil {
+			continue
+		}
+		if aws.Int64Value(e.RuleNumber) == defaultACLRuleNumber {
+			continue
+		}
+
+		r := aclRule{
+			RuleNumber: aws.Int64Value(e.RuleNumber),
+			Action:     aws.StringValue(e.RuleAction),
+			Protocol:   aws.StringValue(e.Protocol),
+			IP:         aws.StringValue(e.CidrBlock),
+		}
+		if e.PortRange != nil {
+			r.FromPort = aws.Int64Value(e.PortRange.From)
+			r.ToPort = aws.Int64Value(e.PortRange.To)
+		}
+		if e.IcmpTypeCode != nil {
+			r.FromPort = aws.Int64Value(e.IcmpTypeCode.Type)
+			r.ToPort = aws.Int64Value(e.IcmpTypeCode.Code)
+		}
+
+		rules = append(rules, normalizeACLRule(r))
+	}
+
+	return rules
+}
+
+// diffACLRules returns the live rules to remove, and the desired rules
+// replacing a live rule with the same number or to be created
+func diffACLRules(live, desired []aclRule) (remove, replace, create []aclRule) {
+	wanted := make(map[int64]aclRule)
+	for _, r := range desired {
+		wanted[r.RuleNumber] = normalizeACLRule(r)
+	}
+
+	existing := make(map[int64]aclRule)
+	for _, r := range live {
+		existing[r.RuleNumber] = r
+		if _, ok := wanted[r.RuleNumber]; !ok {
+			remove = append(remove, r)
+		}
+	}
+
+	for _, r := range desired {
+		current, ok := existing[r.RuleNumber]
+		switch {
+		case !ok:
+			create = append(create, r)
+		case current != wanted[r.RuleNumber]:
+			replace = append(replace, r)
+		}
+	}
+
+	return remove, replace, create
+}
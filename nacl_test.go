@@ -0,0 +1,200 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+var (
+	testACLEntries = []*ec2.NetworkAclEntry{
+		&ec2.NetworkAclEntry{
+			RuleNumber: aws.Int64(100),
+			Egress:     aws.Bool(false),
+			Protocol:   aws.String("6"),
+			RuleAction: aws.String("allow"),
+			CidrBlock:  aws.String("10.0.0.0/16"),
+			PortRange:  &ec2.PortRange{From: aws.Int64(80), To: aws.Int64(80)},
+		},
+		&ec2.NetworkAclEntry{
+			RuleNumber: aws.Int64(110),
+			Egress:     aws.Bool(false),
+			Protocol:   aws.String("6"),
+			RuleAction: aws.String("allow"),
+			CidrBlock:  aws.String("10.0.0.0/16"),
+			PortRange:  &ec2.PortRange{From: aws.Int64(443), To: aws.Int64(443)},
+		},
+		&ec2.NetworkAclEntry{
+			RuleNumber:   aws.Int64(120),
+			Egress:       aws.Bool(false),
+			Protocol:     aws.String("1"),
+			RuleAction:   aws.String("deny"),
+			CidrBlock:    aws.String("0.0.0.0/0"),
+			IcmpTypeCode: &ec2.IcmpTypeCode{Type: aws.Int64(8), Code: aws.Int64(-1)},
+		},
+		&ec2.NetworkAclEntry{
+			RuleNumber: aws.Int64(100),
+			Egress:     aws.Bool(true),
+			Protocol:   aws.String("-1"),
+			RuleAction: aws.String("allow"),
+			CidrBlock:  aws.String("0.0.0.0/0"),
+		},
+		&ec2.NetworkAclEntry{
+			RuleNumber: aws.Int64(32767),
+			Egress:     aws.Bool(false),
+			Protocol:   aws.String("-1"),
+			RuleAction: aws.String("deny"),
+			CidrBlock:  aws.String("0.0.0.0/0"),
+		},
+	}
+)
+
+func testACLEvent() Event {
+	ev := testEvent
+	ev.NetworkAWSID = "subnet-0000000"
+	ev.NetworkACLRules = &aclRules{
+		Ingress: []aclRule{
+			aclRule{RuleNumber: 100, Action: "allow", Protocol: "tcp", IP: "10.0.0.0/16", FromPort: 80, ToPort: 80},
+			aclRule{RuleNumber: 110, Action: "deny", Protocol: "tcp", IP: "10.0.0.0/16", FromPort: 443, ToPort: 443},
+			aclRule{RuleNumber: 130, Action: "allow", Protocol: "udp", IP: "10.0.0.0/16", FromPort: 53, ToPort: 53},
+		},
+		Egress: []aclRule{
+			aclRule{RuleNumber: 100, Action: "allow", Protocol: "all", IP: "0.0.0.0/0"},
+		},
+	}
+	return ev
+}
+
+func TestNetworkACL(t *testing.T) {
+	Convey("Given a network acl event", t, func() {
+		ev := testACLEvent()
+
+		Convey("With valid fields", func() {
+			Convey("It should not error", func() {
+				So(ev.ValidateNetworkACL(), ShouldBeNil)
+			})
+		})
+
+		Convey("With no network aws id", func() {
+			ev.NetworkAWSID = ""
+			Convey("It should error", func() {
+				So(ev.ValidateNetworkACL(), ShouldEqual, ErrNetworkAWSIDInvalid)
+			})
+		})
+
+		Convey("With no rules", func() {
+			ev.NetworkACLRules = nil
+			Convey("It should error", func() {
+				So(ev.ValidateNetworkACL(), ShouldEqual, ErrACLRulesInvalid)
+			})
+		})
+
+		Convey("With the default rule number", func() {
+			ev.NetworkACLRules.Ingress[0].RuleNumber = 32767
+			Convey("It should error", func() {
+				So(ev.ValidateNetworkACL(), ShouldEqual, ErrACLRuleNumberInvalid)
+			})
+		})
+
+		Convey("With a duplicated rule number", func() {
+			ev.NetworkACLRules.Ingress[1].RuleNumber = 100
+			Convey("It should error", func() {
+				So(ev.ValidateNetworkACL(), ShouldEqual, ErrACLRuleNumberDuplicate)
+			})
+		})
+
+		Convey("With an invalid action", func() {
+			ev.NetworkACLRules.Egress[0].Action = "reject"
+			Convey("It should error", func() {
+				So(ev.ValidateNetworkACL(), ShouldEqual, ErrACLRuleActionInvalid)
+			})
+		})
+
+		Convey("With an invalid ip", func() {
+			ev.NetworkACLRules.Egress[0].IP = "0.0.0.0"
+			Convey("It should error", func() {
+				So(ev.ValidateNetworkACL(), ShouldEqual, ErrACLRuleIPInvalid)
+			})
+		})
+
+		Convey("With an unsupported protocol", func() {
+			ev.NetworkACLRules.Ingress[2].Protocol = "gre"
+			Convey("It should error", func() {
+				So(ev.ValidateNetworkACL(), ShouldEqual, ErrACLRuleProtocolInvalid)
+			})
+		})
+
+		Convey("With a port range ending before it starts", func() {
+			ev.NetworkACLRules.Ingress[0].FromPort = 8080
+			Convey("It should error", func() {
+				So(ev.ValidateNetworkACL(), ShouldEqual, ErrACLRuleToPortInvalid)
+			})
+		})
+
+		Convey("With any port on a tcp rule", func() {
+			ev.NetworkACLRules.Ingress[0].FromPort = -1
+			Convey("It should error", func() {
+				So(ev.ValidateNetworkACL(), ShouldEqual, ErrACLRuleFromPortInvalid)
+			})
+		})
+
+		Convey("With any type and code on an icmp rule", func() {
+			ev.NetworkACLRules.Ingress[2].Protocol = "icmp"
+			ev.NetworkACLRules.Ingress[2].FromPort = -1
+			ev.NetworkACLRules.Ingress[2].ToPort = -1
+			Convey("It should not error", func() {
+				So(ev.ValidateNetworkACL(), ShouldBeNil)
+			})
+		})
+
+		Convey("When mapping the live entries to rules", func() {
+			ingress := buildACLRules(testACLEntries, false)
+			egress := buildACLRules(testACLEntries, true)
+			Convey("It should leave out the default entry", func() {
+				So(len(ingress), ShouldEqual, 3)
+				So(ingress[0], ShouldResemble, aclRule{RuleNumber: 100, Action: "allow", Protocol: "6", IP: "10.0.0.0/16", FromPort: 80, ToPort: 80})
+				So(ingress[2], ShouldResemble, aclRule{RuleNumber: 120, Action: "deny", Protocol: "1", IP: "0.0.0.0/0", FromPort: 8, ToPort: -1})
+				So(len(egress), ShouldEqual, 1)
+				So(egress[0].Protocol, ShouldEqual, "-1")
+			})
+		})
+
+		Convey("When diffing the live entries with the event", func() {
+			remove, replace, create := diffACLRules(buildACLRules(testACLEntries, false), ev.NetworkACLRules.Ingress)
+			Convey("It should remove, replace and create the right rules", func() {
+				So(len(remove), ShouldEqual, 1)
+				So(remove[0].RuleNumber, ShouldEqual, 120)
+				So(len(replace), ShouldEqual, 1)
+				So(replace[0].RuleNumber, ShouldEqual, 110)
+				So(len(create), ShouldEqual, 1)
+				So(create[0].RuleNumber, ShouldEqual, 130)
+			})
+
+			remove, replace, create = diffACLRules(buildACLRules(testACLEntries, true), ev.NetworkACLRules.Egress)
+			Convey("It should leave matching rules alone", func() {
+				So(len(remove), ShouldEqual, 0)
+				So(len(replace), ShouldEqual, 0)
+				So(len(create), ShouldEqual, 0)
+			})
+		})
+
+		Convey("When mapping a rule to an entry", func() {
+			e := buildACLEntry(ev.NetworkACLRules.Ingress[2], false)
+			Convey("It should use the protocol number and port range", func() {
+				So(*e.RuleNumber, ShouldEqual, 130)
+				So(*e.Protocol, ShouldEqual, "17")
+				So(*e.RuleAction, ShouldEqual, "allow")
+				So(*e.Egress, ShouldBeFalse)
+				So(*e.PortRange.From, ShouldEqual, 53)
+				So(*e.PortRange.To, ShouldEqual, 53)
+				So(e.IcmpTypeCode, ShouldBeNil)
+			})
+		})
+	})
+}
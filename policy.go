@@ -0,0 +1,237 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var policy *Policy
+
+// Policy declares the rules events must comply with before they are
+// applied, per environment. Events without a known environment use the
+// "default" environment, when declared.
+type Policy struct {
+	Environments map[string]environmentPolicy `yaml:"environments"`
+}
+
+type environmentPolicy struct {
+	AllowedProtocols   []string        `yaml:"allowed_protocols"`
+	RequireDescription bool            `yaml:"require_description"`
+	Ingress            directionPolicy `yaml:"ingress"`
+	Egress             directionPolicy `yaml:"egress"`
+}
+
+type directionPolicy struct {
+	// MaxCIDRWidth is the smallest prefix length an ipv4 rule may use, so
+	// 16 rejects anything wider than a /16, and MaxIPv6CIDRWidth the one an
+	// ipv6 rule may use. Zero allows any width.
+	MaxCIDRWidth     int          `yaml:"max_cidr_width"`
+	MaxIPv6CIDRWidth int          `yaml:"max_ipv6_cidr_width"`
+	Deny             []deniedRule `yaml:"deny"`
+}
+
+// deniedRule rejects rules that open any of its ports, or every port when
+// none are given, to a cidr covering the denied one. A denied 0.0.0.0/0
+// also denies ::/0.
+type deniedRule struct {
+	CIDR     string  `yaml:"cidr"`
+	Protocol string  `yaml:"protocol"`
+	Ports    []int64 `yaml:"ports"`
+}
+
+// PolicyViolation describes a rule rejected by the policy
+type PolicyViolation struct {
+	Direction string `json:"direction"`
+	Rule      rule   `json:"rule"`
+	Reason    string `json:"reason"`
+}
+
+// PolicyError is returned when an event's rules violate the policy
+type PolicyError struct {
+	Violations []PolicyViolation
+}
+
+func (e *PolicyError) Error() string {
+	reasons := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		reasons[i] = v.Direction + " rule " + v.Rule.source() + " " + v.Reason
+	}
+	return "Security Group rules violate policy: " + strings.Join(reasons, ", ")
+}
+
+func loadPolicy(path string) (*Policy, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	if err = yaml.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// Evaluate checks the event's rules against the policy of its environment
+func (p *Policy) Evaluate(ev *Event) error {
+	if p == nil {
+		return nil
+	}
+
+	env, ok := p.Environments[ev.Environment]
+	if !ok {
+		env, ok = p.Environments["default"]
+	}
+	if !ok {
+		return nil
+	}
+
+	var violations []PolicyViolation
+	violations = append(violations, env.evaluate("ingress", env.Ingress, ev.SecurityGroupRules.Ingress)...)
+	violations = append(violations, env.evaluate("egress", env.Egress, ev.egressRules())...)
+
+	if len(violations) > 0 {
+		return &PolicyError{Violations: violations}
+	}
+
+	return nil
+}
+
+func (env environmentPolicy) evaluate(direction string, dp directionPolicy, rules []rule) []PolicyViolation {
+	var violations []PolicyViolation
+
+	for _, r := range expandRules(rules) {
+		for _, reason := range env.check(dp, r) {
+			violations = append(violations, PolicyViolation{
+				Direction: direction,
+				Rule:      r,
+				Reason:    reason,
+			})
+		}
+	}
+
+	return violations
+}
+
+func (env environmentPolicy) check(dp directionPolicy, r rule) []string {
+	var reasons []string
+
+	protocol := protocolName(r.Protocol)
+
+	if len(env.AllowedProtocols) > 0 && !env.allows(protocol) {
+		reasons = append(reasons, "uses protocol "+protocol+" which is not allowed")
+	}
+
+	if env.RequireDescription && r.Description == "" {
+		reasons = append(reasons, "has no description")
+	}
+
+	// groups and prefix lists have no cidr to check
+	if r.cidr() == "" {
+		return reasons
+	}
+
+	_, network, err := net.ParseCIDR(r.cidr())
+	if err != nil {
+		return append(reasons, "has an invalid cidr")
+	}
+
+	maxWidth := dp.MaxCIDRWidth
+	width, bits := network.Mask.Size()
+	if bits == 128 {
+		maxWidth = dp.MaxIPv6CIDRWidth
+	}
+	if maxWidth > 0 && width < maxWidth {
+		reasons = append(reasons, "is wider than /"+strconv.Itoa(maxWidth))
+	}
+
+	for _, d := range dp.Deny {
+		if d.matches(network, protocol, r) {
+			reasons = append(reasons, "opens a port denied to "+d.CIDR)
+		}
+	}
+
+	return reasons
+}
+
+func (env environmentPolicy) allows(protocol string) bool {
+	for _, p := range env.AllowedProtocols {
+		if protocolName(p) == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+func (d deniedRule) matches(network *net.IPNet, protocol string, r rule) bool {
+	_, denied, err := net.ParseCIDR(d.CIDR)
+	if err != nil {
+		return false
+	}
+
+	// denying every ipv4 address denies every ipv6 address too
+	if _, bits := network.Mask.Size(); bits == 128 && denied.String() == "0.0.0.0/0" {
+		_, denied, _ = net.ParseCIDR("::/0")
+	}
+
+	if !covers(network, denied) {
+		return false
+	}
+
+	if d.Protocol != "" && protocol != "all" && protocolName(d.Protocol) != protocol {
+		return false
+	}
+
+	if len(d.Ports) == 0 || protocol == "all" {
+		return true
+	}
+
+	if protocol != "tcp" && protocol != "udp" {
+		return false
+	}
+
+	for _, port := range d.Ports {
+		if port >= r.FromPort && port <= r.ToPort {
+			return true
+		}
+	}
+
+	return false
+}
+
+// covers reports if network a contains all of network b
+func covers(a, b *net.IPNet) bool {
+	aw, abits := a.Mask.Size()
+	bw, bbits := b.Mask.Size()
+	return abits == bbits && aw <= bw && a.Contains(b.IP)
+}
+
+// protocolName maps protocol numbers to the names used by the policy
+func protocolName(protocol string) string {
+	switch strings.ToLower(protocol) {
+	case "6", "tcp":
+		return "tcp"
+	case "17", "udp":
+		return "udp"
+	case "1", "icmp":
+		return "icmp"
+	case "58", "icmpv6":
+		return "icmpv6"
+	case "-1", "all":
+		return "all"
+	}
+	return strings.ToLower(protocol)
+}
@@ -0,0 +1,186 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testPolicy = `
+environments:
+  default:
+    allowed_protocols: [tcp, udp]
+    ingress:
+      max_cidr_width: 8
+      deny:
+        - cidr: 0.0.0.0/0
+          protocol: tcp
+          ports: [22, 3389]
+  production:
+    require_description: true
+    ingress:
+      max_cidr_width: 24
+`
+
+func writeTestPolicy(dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	ioutil.WriteFile(path, []byte(content), 0600)
+	return path
+}
+
+func TestPolicy(t *testing.T) {
+	_, errored := testSetup()
+
+	Convey("Given a policy file", t, func() {
+		dir, _ := ioutil.TempDir("", "policy")
+		p, err := loadPolicy(writeTestPolicy(dir, "policy.yml", testPolicy))
+		So(err, ShouldBeNil)
+
+		ev := testEvent
+		buildTestRules(&ev)
+
+		Convey("When the event complies with the policy", func() {
+			err := p.Evaluate(&ev)
+			Convey("It should not error", func() {
+				So(err, ShouldBeNil)
+			})
+		})
+
+		Convey("When the event opens ssh to the world", func() {
+			ev.SecurityGroupRules.Ingress = []rule{
+				rule{IP: "0.0.0.0/0", FromPort: 20, ToPort: 25, Protocol: "tcp"},
+				rule{IP: "0.0.0.0/0", FromPort: 443, ToPort: 443, Protocol: "tcp"},
+			}
+			err := p.Evaluate(&ev)
+			Convey("It should report the violations", func() {
+				So(err, ShouldNotBeNil)
+				perr := err.(*PolicyError)
+				So(len(perr.Violations), ShouldEqual, 3)
+				So(perr.Violations[0].Direction, ShouldEqual, "ingress")
+				So(perr.Violations[0].Rule.FromPort, ShouldEqual, 20)
+				So(perr.Violations[0].Reason, ShouldEqual, "is wider than /8")
+				So(perr.Violations[1].Reason, ShouldEqual, "opens a port denied to 0.0.0.0/0")
+				So(perr.Violations[2].Rule.FromPort, ShouldEqual, 443)
+				So(perr.Violations[2].Reason, ShouldEqual, "is wider than /8")
+			})
+		})
+
+		Convey("When the event opens all traffic to the world", func() {
+			ev.SecurityGroupRules.Ingress = []rule{
+				rule{IP: "0.0.0.0/0", Protocol: "-1"},
+			}
+			err := p.Evaluate(&ev)
+			Convey("It should report the protocol and the denied ports", func() {
+				So(err, ShouldNotBeNil)
+				perr := err.(*PolicyError)
+				So(len(perr.Violations), ShouldEqual, 3)
+				So(perr.Violations[0].Reason, ShouldEqual, "uses protocol all which is not allowed")
+				So(perr.Violations[2].Reason, ShouldEqual, "opens a port denied to 0.0.0.0/0")
+			})
+		})
+
+		Convey("When the event allows all outbound traffic by default", func() {
+			ev.EgressDefault = egressDefaultAllow
+			err := p.Evaluate(&ev)
+			Convey("It should evaluate the default egress rule", func() {
+				So(err, ShouldNotBeNil)
+				perr := err.(*PolicyError)
+				So(len(perr.Violations), ShouldEqual, 1)
+				So(perr.Violations[0].Direction, ShouldEqual, "egress")
+				So(perr.Violations[0].Reason, ShouldEqual, "uses protocol all which is not allowed")
+			})
+		})
+
+		Convey("When the event opens ssh to every ipv6 address", func() {
+			ev.SecurityGroupRules.Ingress = []rule{
+				rule{IPv6: "::/0", FromPort: 22, ToPort: 22, Protocol: "tcp"},
+			}
+			err := p.Evaluate(&ev)
+			Convey("It should report the port denied to every ipv4 address", func() {
+				So(err, ShouldNotBeNil)
+				perr := err.(*PolicyError)
+				So(len(perr.Violations), ShouldEqual, 1)
+				So(perr.Violations[0].Reason, ShouldEqual, "opens a port denied to 0.0.0.0/0")
+			})
+		})
+
+		Convey("When the policy limits the width of ipv6 cidrs", func() {
+			p, err := loadPolicy(writeTestPolicy(dir, "ipv6.yml", "environments:\n  default:\n    ingress:\n      max_cidr_width: 8\n      max_ipv6_cidr_width: 48\n"))
+			So(err, ShouldBeNil)
+			ev.SecurityGroupRules.Ingress = []rule{
+				rule{IPv6: "2001:db8::/32", FromPort: 443, ToPort: 443, Protocol: "tcp"},
+				rule{IPv6: "2001:db8::/56", FromPort: 443, ToPort: 443, Protocol: "tcp"},
+			}
+			err = p.Evaluate(&ev)
+			Convey("It should report the wider ipv6 cidrs", func() {
+				So(err, ShouldNotBeNil)
+				perr := err.(*PolicyError)
+				So(len(perr.Violations), ShouldEqual, 1)
+				So(perr.Violations[0].Rule.IPv6, ShouldEqual, "2001:db8::/32")
+				So(perr.Violations[0].Reason, ShouldEqual, "is wider than /48")
+			})
+		})
+
+		Convey("When the event is for an environment with its own policy", func() {
+			ev.Environment = "production"
+			ev.SecurityGroupRules.Ingress[0].IP = "10.0.0.0/16"
+			err := p.Evaluate(&ev)
+			Convey("It should apply that environment's rules", func() {
+				So(err, ShouldNotBeNil)
+				perr := err.(*PolicyError)
+				So(len(perr.Violations), ShouldEqual, 3)
+				So(perr.Violations[0].Reason, ShouldEqual, "has no description")
+				So(perr.Violations[1].Reason, ShouldEqual, "is wider than /24")
+				So(perr.Violations[2].Direction, ShouldEqual, "egress")
+				So(perr.Violations[2].Reason, ShouldEqual, "has no description")
+			})
+		})
+
+		Convey("When the policy is written as json", func() {
+			p, err := loadPolicy(writeTestPolicy(dir, "policy.json", `{"environments":{"default":{"allowed_protocols":["udp"]}}}`))
+			So(err, ShouldBeNil)
+			err = p.Evaluate(&ev)
+			Convey("It should be loaded", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "uses protocol tcp which is not allowed")
+			})
+		})
+
+		Convey("When erroring an event that violates the policy", func() {
+			ev.SecurityGroupRules.Ingress[0].IP = "0.0.0.0/0"
+			ev.SecurityGroupRules.Ingress[0].FromPort = 22
+			ev.SecurityGroupRules.Ingress[0].ToPort = 22
+			ev.Error(p.Evaluate(&ev))
+			Convey("It should report the violations on the error event", func() {
+				msg, timeout := waitMsg(errored)
+				So(timeout, ShouldBeNil)
+				var e Event
+				json.Unmarshal(msg.Data, &e)
+				So(len(e.Violations), ShouldEqual, 2)
+				So(e.Violations[1].Rule.IP, ShouldEqual, "0.0.0.0/0")
+			})
+		})
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+
+	Convey("Given no policy", t, func() {
+		var p *Policy
+		ev := testEvent
+		Convey("When evaluating an event", func() {
+			Convey("It should not error", func() {
+				So(p.Evaluate(&ev), ShouldBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,137 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var rc *reconciler
+
+// reconciler keeps the last applied event of every security group and
+// periodically re-applies it when the live group has drifted. Events
+// opting out of reconciliation are still kept, so they follow the cidr
+// groups they reference.
+type reconciler struct {
+	interval time.Duration
+	jitter   time.Duration
+	mu       sync.Mutex
+	events   map[string]Event
+}
+
+func newReconciler(interval, jitter time.Duration) *reconciler {
+	return &reconciler{
+		interval: interval,
+		jitter:   jitter,
+		events:   make(map[string]Event),
+	}
+}
+
+func (r *reconciler) store(ev Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ev.ErrorMessage = ""
+	r.events[ev.SecurityGroupAWSID] = ev
+}
+
+// snapshot returns the events to reconcile
+func (r *reconciler) snapshot() []Event {
+	var events []Event
+	for _, ev := range r.applied() {
+		if !ev.ReconcileDisabled {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+// applied returns the last applied event of every security group
+func (r *reconciler) applied() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	events := make([]Event, 0, len(r.events))
+	for _, ev := range r.events {
+		events = append(events, ev)
+	}
+	return events
+}
+
+func (r *reconciler) wait() time.Duration {
+	if r.jitter <= 0 {
+		return r.interval
+	}
+	return r.interval + time.Duration(rand.Int63n(int64(r.jitter)))
+}
+
+func (r *reconciler) run() {
+	for {
+		time.Sleep(r.wait())
+		for _, ev := range r.snapshot() {
+			r.reconcile(ev)
+		}
+	}
+}
+
+func (r *reconciler) reconcile(ev Event) {
+	ctx, span := ev.startSpan(context.Background(), "reconcile")
+	defer span.End()
+
+	// the policy or cidr groups may have changed since the event was stored
+	if err := checkEvent(ctx, &ev); err != nil {
+		failSpan(span, err)
+		ev.log("reconcile").WithError(err).Error("stored event no longer passes its checks")
+		return
+	}
+
+	d, err := checkFirewall(ctx, &ev)
+	if err != nil {
+		failSpan(span, err)
+		ev.log("reconcile").WithError(err).Error("could not check for drift")
+		return
+	}
+
+	if !d.Detected() {
+		return
+	}
+
+	err = updateFirewall(ctx, &ev)
+	if err != nil {
+		failSpan(span, err)
+		ev.log("reconcile").WithError(err).Error("could not correct drift")
+		return
+	}
+
+	ev.log("reconcile").Info("corrected drift")
+	ev.Reconciled = true
+	ev.inject(ctx)
+	ev.Complete()
+}
+
+// reapply applies a stored event again, as when the cidr groups it
+// references changed, checking it as any new event first
+func (r *reconciler) reapply(ev Event) {
+	ctx, span := ev.startSpan(context.Background(), "reapply")
+	defer span.End()
+
+	ev.inject(ctx)
+
+	err := checkEvent(ctx, &ev)
+	if err == nil {
+		err = updateFirewall(ctx, &ev)
+	}
+	if err != nil {
+		failSpan(span, err)
+		ev.Error(err)
+		return
+	}
+
+	r.store(ev)
+	ev.Complete()
+}
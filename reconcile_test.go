@@ -0,0 +1,116 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestReconciler(t *testing.T) {
+	Convey("Given a reconciler", t, func() {
+		r := newReconciler(time.Minute, time.Second)
+
+		Convey("When storing an applied event", func() {
+			ev := testEvent
+			ev.ErrorMessage = "error"
+			r.store(ev)
+			Convey("It should keep the event for its security group", func() {
+				events := r.snapshot()
+				So(len(events), ShouldEqual, 1)
+				So(events[0].SecurityGroupAWSID, ShouldEqual, "sg-0000000")
+				So(events[0].ErrorMessage, ShouldEqual, "")
+			})
+		})
+
+		Convey("When storing an event that opted out", func() {
+			r.store(testEvent)
+			ev := testEvent
+			ev.ReconcileDisabled = true
+			r.store(ev)
+			Convey("It should not reconcile the security group", func() {
+				So(len(r.snapshot()), ShouldEqual, 0)
+			})
+			Convey("It should keep the event for cidr group updates", func() {
+				So(len(r.applied()), ShouldEqual, 1)
+			})
+		})
+
+		Convey("When waiting for the next run", func() {
+			Convey("It should wait the interval plus some jitter", func() {
+				for i := 0; i < 10; i++ {
+					w := r.wait()
+					So(w, ShouldBeGreaterThanOrEqualTo, time.Minute)
+					So(w, ShouldBeLessThan, time.Minute+time.Second)
+				}
+			})
+		})
+	})
+}
+
+func TestReconcile(t *testing.T) {
+	done, _ := testSetup()
+
+	Convey("Given a stored event whose group drifted", t, func() {
+		ev := testEvent
+		buildTestRules(&ev)
+
+		drifted := buildPermissions([]rule{rule{IP: "10.9.9.9/32", FromPort: 22, ToPort: 22, Protocol: "tcp"}})
+		live := ec2.SecurityGroup{
+			GroupId:             aws.String(ev.SecurityGroupAWSID),
+			GroupName:           aws.String(ev.SecurityGroupName),
+			VpcId:               aws.String(ev.VPCID),
+			IpPermissions:       drifted,
+			IpPermissionsEgress: buildPermissions(ev.SecurityGroupRules.Egress),
+		}
+
+		calls := make(map[string]int)
+		svc := testEC2Client(func(r *request.Request) {
+			calls[r.Operation.Name]++
+			if r.Operation.Name == "DescribeSecurityGroups" {
+				r.Data.(*ec2.DescribeSecurityGroupsOutput).SecurityGroups = []*ec2.SecurityGroup{&live}
+			}
+		})
+		restore := useTestEC2Client(&ev, svc)
+
+		Convey("When reconciling it", func() {
+			newReconciler(time.Minute, 0).reconcile(ev)
+
+			Convey("It should correct the drift", func() {
+				So(calls["RevokeSecurityGroupIngress"], ShouldEqual, 1)
+				So(calls["AuthorizeSecurityGroupIngress"], ShouldEqual, 1)
+				So(calls["RevokeSecurityGroupEgress"], ShouldEqual, 0)
+				So(calls["AuthorizeSecurityGroupEgress"], ShouldEqual, 0)
+			})
+
+			Convey("It should publish a reconciled done event", func() {
+				msg, timeout := waitMsg(done)
+				So(timeout, ShouldBeNil)
+				var reconciled Event
+				json.Unmarshal(msg.Data, &reconciled)
+				So(reconciled.Reconciled, ShouldBeTrue)
+				So(reconciled.SecurityGroupAWSID, ShouldEqual, ev.SecurityGroupAWSID)
+			})
+		})
+
+		Convey("When its cidr group is no longer declared", func() {
+			ev.SecurityGroupRules.Ingress[0].IP = "@monitoring"
+			newReconciler(time.Minute, 0).reconcile(ev)
+
+			Convey("It should not apply it", func() {
+				So(calls["DescribeSecurityGroups"], ShouldEqual, 0)
+				So(calls["AuthorizeSecurityGroupIngress"], ShouldEqual, 0)
+			})
+		})
+
+		Reset(restore)
+	})
+}
@@ -5,12 +5,57 @@
 package main
 
 import (
+	"encoding/json"
 	"reflect"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 )
 
+const (
+	// egressDefaultAllow keeps the allow all egress rule aws adds to new groups
+	egressDefaultAllow = "allow"
+	// egressDefaultStrict only allows the egress rules listed on the event
+	egressDefaultStrict = "strict"
+)
+
+// defaultEgressRule is the allow all egress rule of a new security group
+var defaultEgressRule = rule{IP: "0.0.0.0/0", Protocol: "-1"}
+
+func isDefaultEgressRule(r rule) bool {
+	return r.Protocol == defaultEgressRule.Protocol && r.IP == defaultEgressRule.IP
+}
+
+// hasDefaultEgress checks if a set of permissions holds the default allow
+// all egress rule
+func hasDefaultEgress(perms []*ec2.IpPermission) bool {
+	for _, r := range buildRules(perms) {
+		if isDefaultEgressRule(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultEgressResult describes what happens to the default egress rule
+// when a group moves from the live to the desired permissions
+func defaultEgressResult(live, desired []*ec2.IpPermission) string {
+	had := hasDefaultEgress(live)
+	has := hasDefaultEgress(desired)
+
+	switch {
+	case had && has:
+		return "kept"
+	case has:
+		return "added"
+	case had:
+		return "revoked"
+	}
+	return "absent"
+}
+
 func ruleExists(rule *ec2.IpPermission, ruleset []*ec2.IpPermission) bool {
 	for _, r := range ruleset {
 		if reflect.DeepEqual(*r, *rule) {
@@ -20,16 +65,138 @@ func ruleExists(rule *ec2.IpPermission, ruleset []*ec2.IpPermission) bool {
 	return false
 }
 
+// portRange is a port, or a range of ports written as "8000-8100"
+type portRange string
+
+// UnmarshalJSON accepts ports given as numbers as well as strings
+func (p *portRange) UnmarshalJSON(data []byte) error {
+	var port int64
+	if json.Unmarshal(data, &port) == nil {
+		*p = portRange(strconv.FormatInt(port, 10))
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return ErrSGRulePortsInvalid
+	}
+	*p = portRange(s)
+
+	return nil
+}
+
+func (p portRange) bounds() (from, to int64, err error) {
+	parts := strings.SplitN(string(p), "-", 2)
+
+	from, err = strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+	if err != nil {
+		return 0, 0, ErrSGRulePortsInvalid
+	}
+
+	to = from
+	if len(parts) > 1 {
+		to, err = strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			return 0, 0, ErrSGRulePortsInvalid
+		}
+	}
+
+	if from < 0 || to > 65535 || from > to {
+		return 0, 0, ErrSGRulePortsInvalid
+	}
+
+	return from, to, nil
+}
+
+// expandRules maps rules to atomic rules holding a single cidr, protocol
+// and port range. A rule expands to every combination of its ips and its
+// ports or service ports, in the order they are given, with cidr groups
+// resolved to their cidrs. Rules are expected to be validated, so unknown
+// services, groups and invalid ports are dropped.
+func expandRules(rules []rule) []rule {
+	var expanded []rule
+
+	for _, r := range rules {
+		ips := r.IPs
+		if r.IP != "" {
+			ips = append([]string{r.IP}, r.IPs...)
+		}
+		// rules with another kind of source hold no ips
+		if len(ips) < 1 {
+			ips = []string{""}
+		}
+
+		ports := []servicePort{{r.Protocol, r.FromPort, r.ToPort}}
+		switch {
+		case r.Service != "":
+			ports = services[r.Service]
+		case len(r.Ports) > 0:
+			ports = nil
+			for _, p := range r.Ports {
+				from, to, err := p.bounds()
+				if err == nil {
+					ports = append(ports, servicePort{r.Protocol, from, to})
+				}
+			}
+		}
+
+		for _, ip := range ips {
+			for _, cidr := range resolveIP(ip) {
+				ip, ipv6 := cidr, r.IPv6
+				// cidr groups may hold ipv6 ranges
+				if strings.Contains(cidr, ":") {
+					ip, ipv6 = "", cidr
+				}
+				for _, p := range ports {
+					expanded = append(expanded, rule{
+						IP:               ip,
+						IPv6:             ipv6,
+						SourceGroup:      r.SourceGroup,
+						SourceGroupOwner: r.SourceGroupOwner,
+						PrefixList:       r.PrefixList,
+						FromPort:         p.FromPort,
+						ToPort:           p.ToPort,
+						Protocol:         p.Protocol,
+						Description:      r.Description,
+					})
+				}
+			}
+		}
+	}
+
+	return expanded
+}
+
 func buildPermissions(rules []rule) []*ec2.IpPermission {
 	var perms []*ec2.IpPermission
-	for _, rule := range rules {
+	for _, rule := range expandRules(rules) {
 		p := ec2.IpPermission{
-			FromPort:   aws.Int64(rule.FromPort),
-			ToPort:     aws.Int64(rule.ToPort),
 			IpProtocol: aws.String(rule.Protocol),
 		}
-		ip := ec2.IpRange{CidrIp: aws.String(rule.IP)}
-		p.IpRanges = append(p.IpRanges, &ip)
+		// aws describes all protocol permissions without ports, so they
+		// are left out to compare equal with the live rules
+		if rule.Protocol != "-1" {
+			p.FromPort = aws.Int64(rule.FromPort)
+			p.ToPort = aws.Int64(rule.ToPort)
+		}
+		var description *string
+		if rule.Description != "" {
+			description = aws.String(rule.Description)
+		}
+		switch {
+		case rule.IPv6 != "":
+			p.Ipv6Ranges = []*ec2.Ipv6Range{&ec2.Ipv6Range{CidrIpv6: aws.String(rule.IPv6), Description: description}}
+		case rule.SourceGroup != "":
+			pair := ec2.UserIdGroupPair{GroupId: aws.String(rule.SourceGroup), Description: description}
+			if rule.SourceGroupOwner != "" {
+				pair.UserId = aws.String(rule.SourceGroupOwner)
+			}
+			p.UserIdGroupPairs = []*ec2.UserIdGroupPair{&pair}
+		case rule.PrefixList != "":
+			p.PrefixListIds = []*ec2.PrefixListId{&ec2.PrefixListId{PrefixListId: aws.String(rule.PrefixList), Description: description}}
+		default:
+			p.IpRanges = []*ec2.IpRange{&ec2.IpRange{CidrIp: aws.String(rule.IP), Description: description}}
+		}
 		perms = append(perms, &p)
 	}
 	return perms
@@ -53,3 +220,135 @@ func deduplicateRules(rules, old []*ec2.IpPermission) []*ec2.IpPermission {
 	}
 	return rules
 }
+
+// diffPermissions returns the managed live permissions to revoke and the
+// desired permissions to authorize for a group to match the desired ones.
+// As aws ignores descriptions when matching rules, desired permissions
+// held by an unmanaged rule under another description are left out. Live
+// permissions are expected to be normalized.
+func diffPermissions(desired, live, unmanaged []*ec2.IpPermission) (revoke, authorize []*ec2.IpPermission) {
+	revoke = buildRevokePermissions(live, desired)
+	authorize = deduplicateRules(append([]*ec2.IpPermission{}, desired...), live)
+
+	held := withoutDescriptions(unmanaged)
+	for i := len(authorize) - 1; i >= 0; i-- {
+		if ruleExists(withoutDescriptions(authorize[i : i+1])[0], held) {
+			authorize = append(authorize[:i], authorize[i+1:]...)
+		}
+	}
+
+	return revoke, authorize
+}
+
+// withoutDescriptions returns the permissions as aws matches them
+func withoutDescriptions(perms []*ec2.IpPermission) []*ec2.IpPermission {
+	rules := buildRules(perms)
+	for i := range rules {
+		rules[i].Description = ""
+	}
+	return buildPermissions(rules)
+}
+
+// localPermissions returns the permissions without the owner of source
+// groups in the group's own account, as events only name the owner of
+// groups in other accounts
+func localPermissions(sg *ec2.SecurityGroup, perms []*ec2.IpPermission) []*ec2.IpPermission {
+	local := make([]*ec2.IpPermission, len(perms))
+
+	for i, p := range perms {
+		lp := *p
+		lp.UserIdGroupPairs = nil
+		for _, g := range p.UserIdGroupPairs {
+			pair := *g
+			if aws.StringValue(pair.UserId) == aws.StringValue(sg.OwnerId) {
+				pair.UserId = nil
+			}
+			lp.UserIdGroupPairs = append(lp.UserIdGroupPairs, &pair)
+		}
+		local[i] = &lp
+	}
+
+	return local
+}
+
+// buildRules maps permissions back to rules, a rule per source of each
+// permission
+func buildRules(perms []*ec2.IpPermission) []rule {
+	var rules []rule
+	for _, p := range perms {
+		base := rule{
+			FromPort: aws.Int64Value(p.FromPort),
+			ToPort:   aws.Int64Value(p.ToPort),
+			Protocol: aws.StringValue(p.IpProtocol),
+		}
+		for _, ip := range p.IpRanges {
+			r := base
+			r.IP = aws.StringValue(ip.CidrIp)
+			r.Description = aws.StringValue(ip.Description)
+			rules = append(rules, r)
+		}
+		for _, ip := range p.Ipv6Ranges {
+			r := base
+			r.IPv6 = aws.StringValue(ip.CidrIpv6)
+			r.Description = aws.StringValue(ip.Description)
+			rules = append(rules, r)
+		}
+		for _, g := range p.UserIdGroupPairs {
+			r := base
+			r.SourceGroup = aws.StringValue(g.GroupId)
+			r.SourceGroupOwner = aws.StringValue(g.UserId)
+			r.Description = aws.StringValue(g.Description)
+			rules = append(rules, r)
+		}
+		for _, pl := range p.PrefixListIds {
+			r := base
+			r.PrefixList = aws.StringValue(pl.PrefixListId)
+			r.Description = aws.StringValue(pl.Description)
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// source returns the cidr, group or prefix list a rule opens ports to
+func (r rule) source() string {
+	switch {
+	case r.IPv6 != "":
+		return r.IPv6
+	case r.SourceGroup != "":
+		return r.SourceGroup
+	case r.PrefixList != "":
+		return r.PrefixList
+	}
+	return r.IP
+}
+
+// cidr returns the ipv4 or ipv6 cidr of a rule, if its source is one
+func (r rule) cidr() string {
+	if r.IPv6 != "" {
+		return r.IPv6
+	}
+	return r.IP
+}
+
+// normalizePermissions splits permissions into a permission per source,
+// the way buildPermissions builds them
+func normalizePermissions(perms []*ec2.IpPermission) []*ec2.IpPermission {
+	return buildPermissions(buildRules(perms))
+}
+
+// countRules counts the rules aws accounts for in a set of permissions,
+// where every cidr, group or prefix list of a permission is a rule
+func countRules(perms []*ec2.IpPermission) int {
+	var count int
+	for _, p := range perms {
+		count += len(p.IpRanges) + len(p.Ipv6Ranges) + len(p.UserIdGroupPairs) + len(p.PrefixListIds)
+	}
+	return count
+}
+
+// projectedRules counts the rules a group will hold once the revoked and
+// authorized permissions are applied
+func projectedRules(live, revoke, authorize []*ec2.IpPermission) int {
+	return countRules(live) - countRules(revoke) + countRules(authorize)
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -67,6 +68,29 @@ var (
 			IpProtocol: aws.String("tcp"),
 		},
 	}
+	testMergedRuleset = []*ec2.IpPermission{
+		&ec2.IpPermission{
+			IpRanges: []*ec2.IpRange{
+				&ec2.IpRange{
+					CidrIp: aws.String("10.0.10.100/32"),
+				},
+				&ec2.IpRange{
+					CidrIp: aws.String("10.0.10.101/32"),
+				},
+			},
+			FromPort:   aws.Int64(80),
+			ToPort:     aws.Int64(8080),
+			IpProtocol: aws.String("tcp"),
+		},
+		&ec2.IpPermission{
+			IpRanges: []*ec2.IpRange{
+				&ec2.IpRange{
+					CidrIp: aws.String("0.0.0.0/0"),
+				},
+			},
+			IpProtocol: aws.String("-1"),
+		},
+	}
 	testNewRulesetAddition = []*ec2.IpPermission{
 		&ec2.IpPermission{
 			IpRanges: []*ec2.IpRange{
@@ -127,6 +151,31 @@ func TestRuleset(t *testing.T) {
 			})
 		})
 
+		Convey("When mapping IpPermissions back to rules", func() {
+			rules := buildRules(testMergedRuleset)
+			Convey("It should expand each cidr into a rule", func() {
+				So(len(rules), ShouldEqual, 3)
+				So(rules[0].IP, ShouldEqual, "10.0.10.100/32")
+				So(rules[0].FromPort, ShouldEqual, 80)
+				So(rules[0].ToPort, ShouldEqual, 8080)
+				So(rules[0].Protocol, ShouldEqual, "tcp")
+				So(rules[1].IP, ShouldEqual, "10.0.10.101/32")
+				So(rules[1].FromPort, ShouldEqual, 80)
+				So(rules[1].ToPort, ShouldEqual, 8080)
+				So(rules[1].Protocol, ShouldEqual, "tcp")
+				So(rules[2].IP, ShouldEqual, "0.0.0.0/0")
+				So(rules[2].FromPort, ShouldEqual, 0)
+				So(rules[2].ToPort, ShouldEqual, 0)
+				So(rules[2].Protocol, ShouldEqual, "-1")
+			})
+		})
+
+		Convey("When counting the rules of merged IpPermissions", func() {
+			Convey("It should count every cidr as a rule", func() {
+				So(countRules(testMergedRuleset), ShouldEqual, 3)
+			})
+		})
+
 		Convey("When mapping IpPermissions to revoke", func() {
 			revokeRuleset := buildRevokePermissions(testOldRuleset, testNewRuleset)
 			Convey("It should produce the correct output", func() {
@@ -152,5 +201,94 @@ func TestRuleset(t *testing.T) {
 				So(len(dedupeRuleset), ShouldEqual, 1)
 			})
 		})
+
+		Convey("When mapping an all protocol rule to IpPermissions", func() {
+			ruleset := buildPermissions([]rule{defaultEgressRule})
+			Convey("It should match the rule as aws describes it", func() {
+				So(ruleset[0].FromPort, ShouldBeNil)
+				So(ruleset[0].ToPort, ShouldBeNil)
+				So(ruleExists(testMergedRuleset[1], ruleset), ShouldBeTrue)
+			})
+		})
+
+		Convey("When comparing the default egress rule", func() {
+			Convey("It should report what happens to it", func() {
+				So(defaultEgressResult(testMergedRuleset, testMergedRuleset), ShouldEqual, "kept")
+				So(defaultEgressResult(testOldRuleset, testMergedRuleset), ShouldEqual, "added")
+				So(defaultEgressResult(testMergedRuleset, testOldRuleset), ShouldEqual, "revoked")
+				So(defaultEgressResult(testOldRuleset, testNewRuleset), ShouldEqual, "absent")
+			})
+		})
+
+		Convey("When expanding rules with several ips and ports", func() {
+			var r rule
+			json.Unmarshal([]byte(`{"ip": "10.0.0.1/32", "ips": ["10.0.0.2/32", "10.0.0.3/32"], "ports": [22, "8000-8100"], "protocol": "tcp"}`), &r)
+			expanded := expandRules([]rule{r})
+			Convey("It should produce a rule per ip and port in order", func() {
+				So(len(expanded), ShouldEqual, 6)
+				So(expanded[0], ShouldResemble, rule{IP: "10.0.0.1/32", FromPort: 22, ToPort: 22, Protocol: "tcp"})
+				So(expanded[1], ShouldResemble, rule{IP: "10.0.0.1/32", FromPort: 8000, ToPort: 8100, Protocol: "tcp"})
+				So(expanded[2].IP, ShouldEqual, "10.0.0.2/32")
+				So(expanded[5], ShouldResemble, rule{IP: "10.0.0.3/32", FromPort: 8000, ToPort: 8100, Protocol: "tcp"})
+			})
+		})
+
+		Convey("When reading port ranges", func() {
+			Convey("It should accept single ports and ranges", func() {
+				from, to, err := portRange("443").bounds()
+				So(err, ShouldBeNil)
+				So(from, ShouldEqual, 443)
+				So(to, ShouldEqual, 443)
+				from, to, err = portRange("8000-8100").bounds()
+				So(err, ShouldBeNil)
+				So(from, ShouldEqual, 8000)
+				So(to, ShouldEqual, 8100)
+			})
+
+			Convey("It should reject invalid ranges", func() {
+				for _, p := range []portRange{"", "http", "8100-8000", "0-70000", "-1"} {
+					_, _, err := p.bounds()
+					So(err, ShouldEqual, ErrSGRulePortsInvalid)
+				}
+			})
+		})
+
+		Convey("When mapping IpPermissions with other sources back to rules", func() {
+			perms := []*ec2.IpPermission{
+				&ec2.IpPermission{
+					FromPort:   aws.Int64(443),
+					ToPort:     aws.Int64(443),
+					IpProtocol: aws.String("tcp"),
+					Ipv6Ranges: []*ec2.Ipv6Range{
+						&ec2.Ipv6Range{CidrIpv6: aws.String("::/0")},
+					},
+					UserIdGroupPairs: []*ec2.UserIdGroupPair{
+						&ec2.UserIdGroupPair{GroupId: aws.String("sg-1111111"), UserId: aws.String("123456789012"), Description: aws.String("web")},
+					},
+					PrefixListIds: []*ec2.PrefixListId{
+						&ec2.PrefixListId{PrefixListId: aws.String("pl-1111111")},
+					},
+				},
+			}
+			rules := buildRules(perms)
+
+			Convey("It should keep every source", func() {
+				So(len(rules), ShouldEqual, 3)
+				So(rules[0].IPv6, ShouldEqual, "::/0")
+				So(rules[1].SourceGroup, ShouldEqual, "sg-1111111")
+				So(rules[1].Description, ShouldEqual, "web")
+				So(rules[2].PrefixList, ShouldEqual, "pl-1111111")
+			})
+
+			Convey("It should map the rules to the same permissions", func() {
+				rebuilt := buildPermissions(rules)
+				So(len(rebuilt), ShouldEqual, 3)
+				So(*rebuilt[0].Ipv6Ranges[0].CidrIpv6, ShouldEqual, "::/0")
+				So(*rebuilt[1].UserIdGroupPairs[0].GroupId, ShouldEqual, "sg-1111111")
+				So(*rebuilt[2].PrefixListIds[0].PrefixListId, ShouldEqual, "pl-1111111")
+				So(len(buildRevokePermissions(normalizePermissions(perms), rebuilt)), ShouldEqual, 0)
+				So(countRules(rebuilt), ShouldEqual, countRules(perms))
+			})
+		})
 	})
 }
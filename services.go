@@ -0,0 +1,101 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrServiceInvalid         = errors.New("Service definition must contain ports")
+	ErrServiceProtocolInvalid = errors.New("Service definition protocol invalid")
+	ErrServicePortInvalid     = errors.New("Service definition port invalid")
+)
+
+type servicePort struct {
+	Protocol string `yaml:"protocol"`
+	FromPort int64  `yaml:"from_port"`
+	ToPort   int64  `yaml:"to_port"`
+}
+
+// services maps the names rules can use in place of a protocol and port
+// range, extended by the SERVICES_FILE
+var services = map[string][]servicePort{
+	"dns":      {{"tcp", 53, 53}, {"udp", 53, 53}},
+	"http":     {{"tcp", 80, 80}},
+	"https":    {{"tcp", 443, 443}},
+	"ldap":     {{"tcp", 389, 389}},
+	"ldaps":    {{"tcp", 636, 636}},
+	"mongodb":  {{"tcp", 27017, 27017}},
+	"mysql":    {{"tcp", 3306, 3306}},
+	"ntp":      {{"udp", 123, 123}},
+	"postgres": {{"tcp", 5432, 5432}},
+	"rdp":      {{"tcp", 3389, 3389}},
+	"redis":    {{"tcp", 6379, 6379}},
+	"smtp":     {{"tcp", 25, 25}},
+	"ssh":      {{"tcp", 22, 22}},
+}
+
+// loadServices adds the services declared in a yaml file to the built in
+// ones, replacing those with the same name
+func loadServices(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var declared map[string][]servicePort
+	if err = yaml.Unmarshal(data, &declared); err != nil {
+		return err
+	}
+
+	for _, ports := range declared {
+		if len(ports) < 1 {
+			return ErrServiceInvalid
+		}
+		for _, p := range ports {
+			if err = p.validate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, ports := range declared {
+		services[name] = ports
+	}
+
+	return nil
+}
+
+// validate checks the port range is one aws accepts for the protocol,
+// where icmp ranges hold a type and code that can be -1 for any
+func (p servicePort) validate() error {
+	min, max := int64(0), int64(65535)
+
+	switch protocolName(p.Protocol) {
+	case "":
+		return ErrServiceProtocolInvalid
+	case "icmp":
+		min, max = -1, 255
+	case "all":
+		return nil
+	}
+
+	if p.FromPort < min || p.FromPort > max || p.ToPort < min || p.ToPort > max {
+		return ErrServicePortInvalid
+	}
+	if protocolName(p.Protocol) != "icmp" && p.FromPort > p.ToPort {
+		return ErrServicePortInvalid
+	}
+
+	return nil
+}
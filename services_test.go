@@ -0,0 +1,96 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testServices = `
+grafana:
+  - protocol: tcp
+    from_port: 3000
+    to_port: 3000
+ssh:
+  - protocol: tcp
+    from_port: 2222
+    to_port: 2222
+`
+
+func TestServices(t *testing.T) {
+	Convey("Given rules referencing services", t, func() {
+		rules := []rule{
+			rule{IP: "10.0.0.0/24", Service: "dns", Description: "resolvers"},
+			rule{IP: "10.0.1.0/24", FromPort: 80, ToPort: 80, Protocol: "tcp"},
+		}
+
+		Convey("When expanding them", func() {
+			expanded := expandRules(rules)
+			Convey("It should produce a rule per service port", func() {
+				So(len(expanded), ShouldEqual, 3)
+				So(expanded[0], ShouldResemble, rule{IP: "10.0.0.0/24", FromPort: 53, ToPort: 53, Protocol: "tcp", Description: "resolvers"})
+				So(expanded[1], ShouldResemble, rule{IP: "10.0.0.0/24", FromPort: 53, ToPort: 53, Protocol: "udp", Description: "resolvers"})
+				So(expanded[2], ShouldResemble, rules[1])
+			})
+		})
+
+		Convey("When mapping them to IpPermissions", func() {
+			perms := buildPermissions(rules)
+			Convey("It should use the service ports", func() {
+				So(len(perms), ShouldEqual, 3)
+				So(*perms[1].IpProtocol, ShouldEqual, "udp")
+				So(*perms[1].FromPort, ShouldEqual, 53)
+			})
+		})
+	})
+
+	Convey("Given a services file", t, func() {
+		dir, _ := ioutil.TempDir("", "services")
+		ssh := services["ssh"]
+
+		Convey("When loading it", func() {
+			err := loadServices(writeTestPolicy(dir, "services.yml", testServices))
+			Convey("It should add and replace services", func() {
+				So(err, ShouldBeNil)
+				So(services["grafana"][0].FromPort, ShouldEqual, 3000)
+				So(services["ssh"][0].FromPort, ShouldEqual, 2222)
+				So(services["https"][0].FromPort, ShouldEqual, 443)
+			})
+		})
+
+		Convey("When a service has no ports", func() {
+			err := loadServices(writeTestPolicy(dir, "services.yml", "grafana: []"))
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrServiceInvalid)
+			})
+		})
+
+		Convey("When a service has no protocol", func() {
+			err := loadServices(writeTestPolicy(dir, "services.yml", "grafana:\n  - from_port: 3000\n    to_port: 3000\n"))
+			Convey("It should error without adding any service", func() {
+				So(err, ShouldEqual, ErrServiceProtocolInvalid)
+				_, ok := services["grafana"]
+				So(ok, ShouldBeFalse)
+			})
+		})
+
+		Convey("When a service has an out of range port", func() {
+			err := loadServices(writeTestPolicy(dir, "services.yml", "grafana:\n  - protocol: tcp\n    from_port: 3000\n    to_port: 70000\n"))
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrServicePortInvalid)
+			})
+		})
+
+		Reset(func() {
+			delete(services, "grafana")
+			services["ssh"] = ssh
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -0,0 +1,127 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// tags guarding which groups the connector may modify. Groups must carry
+// the ownership tag, when one is configured, and must not carry the
+// protected tag.
+var (
+	ownershipTagKey   string
+	ownershipTagValue string
+	protectedTagKey   = "protected"
+)
+
+// configureTags sets the ownership tag, given as "key" or "key=value", and
+// the protected tag key when not empty
+func configureTags(ownership, protected string) {
+	parts := strings.SplitN(ownership, "=", 2)
+	ownershipTagKey = parts[0]
+	ownershipTagValue = ""
+	if len(parts) > 1 {
+		ownershipTagValue = parts[1]
+	}
+
+	if protected != "" {
+		protectedTagKey = protected
+	}
+}
+
+func tagValue(tags []*ec2.Tag, key string) (string, bool) {
+	for _, t := range tags {
+		if aws.StringValue(t.Key) == key {
+			return aws.StringValue(t.Value), true
+		}
+	}
+	return "", false
+}
+
+// buildTags maps the group tags to event tags, leaving out the ones
+// reserved by aws
+func buildTags(tags []*ec2.Tag) map[string]string {
+	var built map[string]string
+
+	for _, t := range tags {
+		key := aws.StringValue(t.Key)
+		if strings.HasPrefix(key, "aws:") {
+			continue
+		}
+		if built == nil {
+			built = make(map[string]string)
+		}
+		built[key] = aws.StringValue(t.Value)
+	}
+
+	return built
+}
+
+// verifyOwnership ensures the connector is allowed to modify the group
+func verifyOwnership(sg *ec2.SecurityGroup) error {
+	if _, ok := tagValue(sg.Tags, protectedTagKey); ok {
+		return ErrSGProtected
+	}
+
+	if ownershipTagKey == "" {
+		return nil
+	}
+
+	value, ok := tagValue(sg.Tags, ownershipTagKey)
+	if !ok || ownershipTagValue != "" && value != ownershipTagValue {
+		return ErrSGNotOwned
+	}
+
+	return nil
+}
+
+// changedTags returns the event tags missing from the group or holding
+// another value, sorted by key
+func changedTags(sg *ec2.SecurityGroup, tags map[string]string) []*ec2.Tag {
+	var changed []*ec2.Tag
+
+	for key, value := range tags {
+		if current, ok := tagValue(sg.Tags, key); ok && current == value {
+			continue
+		}
+		changed = append(changed, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+
+	sort.Slice(changed, func(i, j int) bool {
+		return aws.StringValue(changed[i].Key) < aws.StringValue(changed[j].Key)
+	})
+
+	return changed
+}
+
+func updateTags(ctx context.Context, svc *ec2.EC2, ev *Event, sg *ec2.SecurityGroup) error {
+	tags := changedTags(sg, ev.Tags)
+	if len(tags) < 1 {
+		return nil
+	}
+
+	req := ec2.CreateTagsInput{
+		Resources: []*string{sg.GroupId},
+		Tags:      tags,
+	}
+
+	err := ev.traced(ctx, "CreateTags", func(ctx context.Context) error {
+		_, err := svc.CreateTagsWithContext(ctx, &req)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	ev.log("firewall.update.aws").Infof("updated %d tags", len(tags))
+
+	return nil
+}
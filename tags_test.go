@@ -0,0 +1,81 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTags(t *testing.T) {
+	Convey("Given a tagged security group", t, func() {
+		sg := ec2.SecurityGroup{
+			GroupId: aws.String("sg-0000000"),
+			Tags: []*ec2.Tag{
+				&ec2.Tag{Key: aws.String("managed-by"), Value: aws.String("ernest")},
+				&ec2.Tag{Key: aws.String("team"), Value: aws.String("web")},
+				&ec2.Tag{Key: aws.String("aws:cloudformation:stack-name"), Value: aws.String("stack")},
+			},
+		}
+
+		Convey("When no ownership tag is configured", func() {
+			configureTags("", "")
+			Convey("It should allow changes", func() {
+				So(verifyOwnership(&sg), ShouldBeNil)
+			})
+		})
+
+		Convey("When the group carries the ownership tag", func() {
+			configureTags("managed-by=ernest", "")
+			Convey("It should allow changes", func() {
+				So(verifyOwnership(&sg), ShouldBeNil)
+			})
+		})
+
+		Convey("When the ownership tag has another value", func() {
+			configureTags("managed-by=terraform", "")
+			Convey("It should error", func() {
+				So(verifyOwnership(&sg), ShouldEqual, ErrSGNotOwned)
+			})
+		})
+
+		Convey("When the group misses the ownership tag", func() {
+			configureTags("owner", "")
+			Convey("It should error", func() {
+				So(verifyOwnership(&sg), ShouldEqual, ErrSGNotOwned)
+			})
+		})
+
+		Convey("When the group carries the protected tag", func() {
+			configureTags("managed-by", "team")
+			Convey("It should error", func() {
+				So(verifyOwnership(&sg), ShouldEqual, ErrSGProtected)
+			})
+		})
+
+		Convey("When comparing it with the event tags", func() {
+			tags := changedTags(&sg, map[string]string{"team": "api", "managed-by": "ernest", "env": "prod"})
+			Convey("It should only return new or changed tags", func() {
+				So(len(tags), ShouldEqual, 2)
+				So(*tags[0].Key, ShouldEqual, "env")
+				So(*tags[1].Key, ShouldEqual, "team")
+				So(*tags[1].Value, ShouldEqual, "api")
+			})
+		})
+
+		Convey("When mapping it to event tags", func() {
+			Convey("It should leave out the aws tags", func() {
+				So(buildTags(sg.Tags), ShouldResemble, map[string]string{"managed-by": "ernest", "team": "web"})
+			})
+		})
+
+		Reset(func() {
+			configureTags("", "protected")
+		})
+	})
+}
@@ -0,0 +1,104 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/ernestio/firewall-updater-aws-connector"
+
+// ErrTraceExporterInvalid is returned for exporters other than stdout and file
+var ErrTraceExporterInvalid = errors.New("Trace exporter invalid")
+
+func init() {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// configureTracing sets up the span exporter, returning a function that
+// flushes pending spans. Spans are not exported when no exporter is given.
+func configureTracing(exporter, path string) (func(context.Context) error, error) {
+	var w io.Writer
+
+	switch exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		w = os.Stdout
+	case "file":
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	default:
+		return nil, ErrTraceExporterInvalid
+	}
+
+	exp, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp))
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// context returns the trace context carried by the event
+func (ev *Event) context() context.Context {
+	return otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(ev.TraceContext))
+}
+
+// inject stores the trace context into the event, so it is propagated on
+// the messages published for it
+func (ev *Event) inject(ctx context.Context) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		ev.TraceContext = carrier
+	}
+}
+
+func (ev *Event) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(
+		attribute.String("uuid", ev.UUID),
+		attribute.String("batch_id", ev.BatchID),
+		attribute.String("security_group_aws_id", ev.SecurityGroupAWSID),
+		attribute.String("region", ev.DatacenterRegion),
+	))
+}
+
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		failSpan(span, err)
+	}
+	span.End()
+}
+
+// traced runs fn within a span named after the operation
+func (ev *Event) traced(ctx context.Context, operation string, fn func(context.Context) error) error {
+	ctx, span := ev.startSpan(ctx, operation)
+	err := fn(ctx)
+	endSpan(span, err)
+	return err
+}
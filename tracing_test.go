@@ -0,0 +1,65 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTracing(t *testing.T) {
+	Convey("Given a tracing configuration", t, func() {
+		Convey("When the exporter is unknown", func() {
+			_, err := configureTracing("jaeger", "")
+			Convey("It should error", func() {
+				So(err, ShouldEqual, ErrTraceExporterInvalid)
+			})
+		})
+
+		Convey("When exporting to a file", func() {
+			dir, _ := ioutil.TempDir("", "traces")
+			path := filepath.Join(dir, "traces.json")
+			shutdown, err := configureTracing("file", path)
+			So(err, ShouldBeNil)
+
+			ev := testEvent
+			ctx, span := ev.startSpan(context.Background(), "firewall.update.aws")
+			ev.inject(ctx)
+			ev.traced(ctx, "validate", func(context.Context) error { return nil })
+			span.End()
+			shutdown(context.Background())
+
+			Convey("It should propagate the trace context on the event", func() {
+				data, _ := json.Marshal(ev)
+				var e Event
+				json.Unmarshal(data, &e)
+				sc := trace.SpanContextFromContext(e.context())
+				So(sc.IsValid(), ShouldBeTrue)
+				So(sc.TraceID(), ShouldEqual, span.SpanContext().TraceID())
+				So(sc.SpanID(), ShouldEqual, span.SpanContext().SpanID())
+			})
+
+			Convey("It should write the spans to the file", func() {
+				data, err := ioutil.ReadFile(path)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldContainSubstring, `"Name":"firewall.update.aws"`)
+				So(string(data), ShouldContainSubstring, `"Name":"validate"`)
+			})
+
+			Reset(func() {
+				configureTracing("", "")
+				os.RemoveAll(dir)
+			})
+		})
+	})
+}